@@ -0,0 +1,498 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerSource is how an address of a peer became known
+type PeerSource uint8
+
+const (
+	SourceManual PeerSource = iota
+	SourceDeclaration
+	SourceAnnouncement
+	SourceMDNS
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceManual:
+		return "manual"
+	case SourceDeclaration:
+		return "declaration"
+	case SourceAnnouncement:
+		return "announcement"
+	case SourceMDNS:
+		return "mdns"
+	}
+	return fmt.Sprintf("source(%d)", uint8(s))
+}
+
+// PeerAddress is an address a peer was seen at
+type PeerAddress struct {
+	Addr      *net.UDPAddr
+	Source    PeerSource
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// PeerRecord is everything known about the addresses of a peer
+type PeerRecord struct {
+	Key ed25519.PublicKey
+
+	// Addrs are the peer's addresses, most recently seen first. Declarations aren't dated,
+	// so a replayed declaration makes its address the most recent again.
+	Addrs []PeerAddress
+
+	// Changes counts the changes to the peer's addresses in this address book, it is local
+	// and doesn't order the peer's declarations
+	Changes uint64
+
+	LastSeen time.Time
+}
+
+// Addr returns the most recently seen address of the peer
+func (r PeerRecord) Addr() *net.UDPAddr {
+	if len(r.Addrs) == 0 {
+		return nil
+	}
+	return r.Addrs[0].Addr
+}
+
+func (r PeerRecord) clone() PeerRecord {
+	r.Key = append(ed25519.PublicKey(nil), r.Key...)
+	r.Addrs = append([]PeerAddress(nil), r.Addrs...)
+	return r
+}
+
+// AddressBook remembers the addresses peers were seen at, it is safe for concurrent use
+type AddressBook interface {
+	// Observe records the peer was seen at the address
+	Observe(key ed25519.PublicKey, addr *net.UDPAddr, source PeerSource, seen time.Time) error
+
+	// Lookup returns the record of the peer
+	Lookup(key ed25519.PublicKey) (PeerRecord, bool)
+
+	// Peers returns every record, most recently seen first
+	Peers() []PeerRecord
+
+	// Remove forgets the peer
+	Remove(key ed25519.PublicKey) error
+
+	// Evict applies the eviction policies, returning the number of peers dropped
+	Evict(now time.Time) (int, error)
+}
+
+// ObserveDeclaration records the address of a validated declaration, seen at the time it
+// arrived since declarations carry no time of their own
+func ObserveDeclaration(book AddressBook, p AddressDeclarationPayload, seen time.Time) error {
+	if !p.Validate() {
+		return errors.New("invalid address declaration")
+	}
+
+	addr := &net.UDPAddr{IP: append(net.IP(nil), p.Address[:]...), Port: int(p.Port)}
+	return book.Observe(ed25519.PublicKey(p.Src[:]), addr, SourceDeclaration, seen)
+}
+
+// EvictionPolicy picks the peers to drop from an address book
+type EvictionPolicy func(peers []PeerRecord, now time.Time) []ed25519.PublicKey
+
+// EvictStale drops peers not seen for the duration
+func EvictStale(age time.Duration) EvictionPolicy {
+	return func(peers []PeerRecord, now time.Time) (evict []ed25519.PublicKey) {
+		for _, p := range peers {
+			if now.Sub(p.LastSeen) > age {
+				evict = append(evict, p.Key)
+			}
+		}
+		return
+	}
+}
+
+// EvictLeastRecent drops the least recently seen peers beyond the maximum
+func EvictLeastRecent(max int) EvictionPolicy {
+	return func(peers []PeerRecord, now time.Time) (evict []ed25519.PublicKey) {
+		for i := max; i < len(peers); i++ {
+			evict = append(evict, peers[i].Key)
+		}
+		return
+	}
+}
+
+const (
+	// defaultMaxPeerAddrs is how many addresses are kept for each peer
+	defaultMaxPeerAddrs = 8
+
+	// defaultFlushDelay is how long file address books wait to save changes
+	defaultFlushDelay = time.Second
+)
+
+// AddressBookOption configures an address book
+type AddressBookOption func(*MemoryAddressBook)
+
+// WithEviction sets the policies applied when peers are observed and on Evict
+func WithEviction(policies ...EvictionPolicy) AddressBookOption {
+	return func(b *MemoryAddressBook) {
+		b.policies = policies
+	}
+}
+
+// WithMaxPeerAddrs sets how many addresses are kept for each peer, dropping the least
+// recently seen
+func WithMaxPeerAddrs(n int) AddressBookOption {
+	return func(b *MemoryAddressBook) {
+		b.maxAddrs = n
+	}
+}
+
+// WithFlushDelay sets how long a file address book waits to save changes, so a burst of
+// changes is saved once, 1 second by default. A delay of 0 saves every change immediately.
+func WithFlushDelay(d time.Duration) AddressBookOption {
+	return func(b *MemoryAddressBook) {
+		b.flushDelay = d
+	}
+}
+
+// MemoryAddressBook is an address book held in memory
+type MemoryAddressBook struct {
+	mu       sync.RWMutex
+	peers    map[string]*PeerRecord
+	policies []EvictionPolicy
+	maxAddrs int
+
+	// flushDelay is only used by file address books
+	flushDelay time.Duration
+}
+
+var _ AddressBook = (*MemoryAddressBook)(nil)
+
+// NewMemoryAddressBook returns an empty address book
+func NewMemoryAddressBook(opts ...AddressBookOption) *MemoryAddressBook {
+	b := &MemoryAddressBook{
+		peers:      make(map[string]*PeerRecord),
+		maxAddrs:   defaultMaxPeerAddrs,
+		flushDelay: defaultFlushDelay,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Observe records the peer was seen at the address
+func (b *MemoryAddressBook) Observe(key ed25519.PublicKey, addr *net.UDPAddr, source PeerSource, seen time.Time) error {
+	_, err := b.observe(key, addr, source, seen)
+	return err
+}
+
+// observe returns whether the addresses of the peer changed, as opposed to only being seen
+func (b *MemoryAddressBook) observe(key ed25519.PublicKey, addr *net.UDPAddr, source PeerSource, seen time.Time) (bool, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid peer key length %d", len(key))
+	}
+	if addr == nil || addr.IP == nil {
+		return false, errors.New("peer address is missing")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.peers[string(key)]
+	if !ok {
+		r = &PeerRecord{Key: append(ed25519.PublicKey(nil), key...)}
+		b.peers[string(key)] = r
+	}
+	if seen.After(r.LastSeen) {
+		r.LastSeen = seen
+	}
+
+	changed := !ok
+	i := indexPeerAddr(r.Addrs, addr)
+	if i < 0 {
+		r.Addrs = append(r.Addrs, PeerAddress{Addr: copyUDPAddr(addr), Source: source, FirstSeen: seen})
+		i = len(r.Addrs) - 1
+		changed = true
+	}
+	if seen.After(r.Addrs[i].LastSeen) {
+		r.Addrs[i].LastSeen = seen
+	}
+
+	// Most recently seen first, the order only changes when another address is seen
+	before := r.Addrs[0].Addr
+	sort.SliceStable(r.Addrs, func(i, j int) bool { return r.Addrs[i].LastSeen.After(r.Addrs[j].LastSeen) })
+	if b.maxAddrs > 0 && len(r.Addrs) > b.maxAddrs {
+		r.Addrs = r.Addrs[:b.maxAddrs]
+	}
+	if r.Addrs[0].Addr != before {
+		changed = true
+	}
+
+	if changed {
+		r.Changes++
+	}
+
+	if b.evict(seen) > 0 {
+		changed = true
+	}
+	return changed, nil
+}
+
+// Lookup returns the record of the peer
+func (b *MemoryAddressBook) Lookup(key ed25519.PublicKey) (PeerRecord, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.peers[string(key)]
+	if !ok {
+		return PeerRecord{}, false
+	}
+	return r.clone(), true
+}
+
+// Peers returns every record, most recently seen first
+func (b *MemoryAddressBook) Peers() []PeerRecord {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.sorted()
+}
+
+// Remove forgets the peer
+func (b *MemoryAddressBook) Remove(key ed25519.PublicKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, string(key))
+	return nil
+}
+
+// Evict applies the eviction policies, returning the number of peers dropped
+func (b *MemoryAddressBook) Evict(now time.Time) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.evict(now), nil
+}
+
+func (b *MemoryAddressBook) evict(now time.Time) int {
+	if len(b.policies) == 0 {
+		return 0
+	}
+
+	n := 0
+	for _, policy := range b.policies {
+		for _, key := range policy(b.sorted(), now) {
+			if _, ok := b.peers[string(key)]; ok {
+				delete(b.peers, string(key))
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// sorted returns copies of the records, most recently seen first
+func (b *MemoryAddressBook) sorted() []PeerRecord {
+	peers := make([]PeerRecord, 0, len(b.peers))
+	for _, r := range b.peers {
+		peers = append(peers, r.clone())
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if !peers[i].LastSeen.Equal(peers[j].LastSeen) {
+			return peers[i].LastSeen.After(peers[j].LastSeen)
+		}
+		return bytes.Compare(peers[i].Key, peers[j].Key) < 0
+	})
+	return peers
+}
+
+// FileAddressBook is an address book saved to a file, so peers are remembered across
+// restarts. Changes to addresses are saved after the flush delay, together with any others
+// made meanwhile, while peers only being seen again are saved on Flush and Close.
+type FileAddressBook struct {
+	*MemoryAddressBook
+
+	filename string
+
+	// saveMu orders saves, dirty is set by updates not yet saved
+	saveMu sync.Mutex
+	dirty  bool
+
+	// pending is the delayed save of changes, saveErr the error of the last delayed save
+	pending *time.Timer
+	saveErr error
+}
+
+var _ AddressBook = (*FileAddressBook)(nil)
+
+// addressBookFile is the json format of address book files
+type addressBookFile struct {
+	Version int
+	Peers   []PeerRecord
+}
+
+// OpenAddressBook loads the address book from the file, which is created on the first save
+// if it doesn't exist
+func OpenAddressBook(filename string, opts ...AddressBookOption) (*FileAddressBook, error) {
+	b := &FileAddressBook{MemoryAddressBook: NewMemoryAddressBook(opts...), filename: filename}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f addressBookFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid address book %s: %w", filename, err)
+	}
+	if f.Version != 1 {
+		return nil, fmt.Errorf("unsupported address book version %d", f.Version)
+	}
+
+	for i := range f.Peers {
+		r := f.Peers[i]
+		if len(r.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid peer key length %d in %s", len(r.Key), filename)
+		}
+		b.peers[string(r.Key)] = &r
+	}
+	return b, nil
+}
+
+// Observe records the peer was seen at the address
+func (b *FileAddressBook) Observe(key ed25519.PublicKey, addr *net.UDPAddr, source PeerSource, seen time.Time) error {
+	changed, err := b.observe(key, addr, source, seen)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		b.saveMu.Lock()
+		b.dirty = true
+		b.saveMu.Unlock()
+		return nil
+	}
+	return b.changed()
+}
+
+// Remove forgets the peer
+func (b *FileAddressBook) Remove(key ed25519.PublicKey) error {
+	b.MemoryAddressBook.Remove(key)
+	return b.changed()
+}
+
+// Evict applies the eviction policies, returning the number of peers dropped
+func (b *FileAddressBook) Evict(now time.Time) (int, error) {
+	n, _ := b.MemoryAddressBook.Evict(now)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, b.changed()
+}
+
+// changed schedules a save after the flush delay, returning the error of the last delayed
+// save
+func (b *FileAddressBook) changed() error {
+	if b.flushDelay <= 0 {
+		return b.Flush()
+	}
+
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.dirty = true
+	if b.pending == nil {
+		b.pending = time.AfterFunc(b.flushDelay, b.flushPending)
+	}
+
+	err := b.saveErr
+	b.saveErr = nil
+	return err
+}
+
+// flushPending saves changes when the flush delay is up, unless they were already saved
+func (b *FileAddressBook) flushPending() {
+	b.saveMu.Lock()
+	dirty := b.dirty
+	b.saveMu.Unlock()
+	if !dirty {
+		return
+	}
+
+	if err := b.Flush(); err != nil {
+		b.saveMu.Lock()
+		b.saveErr = err
+		b.saveMu.Unlock()
+	}
+}
+
+// Flush saves the address book
+func (b *FileAddressBook) Flush() error {
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	if b.pending != nil {
+		b.pending.Stop()
+		b.pending = nil
+	}
+
+	data, err := json.MarshalIndent(addressBookFile{Version: 1, Peers: b.Peers()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file in one step so a crash never leaves half an address book
+	tmp, err := ioutil.TempFile(filepath.Dir(b.filename), filepath.Base(b.filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.filename); err != nil {
+		return err
+	}
+
+	b.dirty = false
+	return nil
+}
+
+// Close saves any changes and peers seen since the last save
+func (b *FileAddressBook) Close() error {
+	b.saveMu.Lock()
+	dirty, err := b.dirty, b.saveErr
+	b.saveMu.Unlock()
+
+	if !dirty {
+		return err
+	}
+	return b.Flush()
+}
+
+func indexPeerAddr(addrs []PeerAddress, addr *net.UDPAddr) int {
+	for i, a := range addrs {
+		if a.Addr.IP.Equal(addr.IP) && a.Addr.Port == addr.Port && a.Addr.Zone == addr.Zone {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone}
+}
@@ -0,0 +1,168 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryAddressBook(t *testing.T) {
+	b := NewMemoryAddressBook(WithMaxPeerAddrs(2))
+	key := testKey(1).Public().(ed25519.PublicKey)
+	now := time.Unix(1000, 0)
+
+	a1 := &net.UDPAddr{IP: net.ParseIP("ff1e::1"), Port: 1024}
+	a2 := &net.UDPAddr{IP: net.ParseIP("ff1e::2"), Port: 1024}
+	a3 := &net.UDPAddr{IP: net.ParseIP("224.0.230.1"), Port: 1024}
+
+	b.Observe(key, a1, SourceDeclaration, now)
+	b.Observe(key, a2, SourceMDNS, now.Add(time.Second))
+	b.Observe(key, a1, SourceDeclaration, now.Add(2*time.Second))
+
+	r, ok := b.Lookup(key)
+	if !ok || r.Addr().String() != a1.String() || len(r.Addrs) != 2 || r.Addrs[1].Source != SourceMDNS {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if r.Changes != 3 || !r.LastSeen.Equal(now.Add(2*time.Second)) || !r.Addrs[0].FirstSeen.Equal(now) {
+		t.Errorf("unexpected changes %d or times %+v", r.Changes, r)
+	}
+
+	// The least recently seen address is dropped beyond the maximum
+	b.Observe(key, a3, SourceAnnouncement, now.Add(3*time.Second))
+	if r, _ := b.Lookup(key); len(r.Addrs) != 2 || r.Addr().String() != a3.String() || r.Addrs[1].Addr.String() != a1.String() {
+		t.Errorf("unexpected addresses %+v", r.Addrs)
+	}
+
+	// Records are copies
+	r.Addrs[0].Addr = nil
+	if r, _ := b.Lookup(key); r.Addr() == nil {
+		t.Error("expected lookups to return copies")
+	}
+
+	if err := b.Observe(key[:8], a1, SourceManual, now); err == nil {
+		t.Error("expected a short key to fail")
+	}
+
+	b.Remove(key)
+	if _, ok := b.Lookup(key); ok {
+		t.Error("expected the peer to be removed")
+	}
+}
+
+func TestAddressBookEviction(t *testing.T) {
+	b := NewMemoryAddressBook(WithEviction(EvictStale(time.Minute), EvictLeastRecent(2)))
+	now := time.Unix(1000, 0)
+	addr := &net.UDPAddr{IP: net.ParseIP("ff1e::1"), Port: 1024}
+
+	for i := 0; i < 3; i++ {
+		b.Observe(testKey(byte(i)).Public().(ed25519.PublicKey), addr, SourceDeclaration, now.Add(time.Duration(i)*time.Second))
+	}
+
+	peers := b.Peers()
+	if len(peers) != 2 || !bytes.Equal(peers[0].Key, testKey(2).Public().(ed25519.PublicKey)) {
+		t.Fatalf("expected the least recent peer to be evicted, got %d peers", len(peers))
+	}
+
+	if n, _ := b.Evict(now.Add(time.Minute + 1500*time.Millisecond)); n != 1 {
+		t.Errorf("expected 1 stale peer evicted, got %d", n)
+	}
+}
+
+func TestFileAddressBook(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peers.json")
+	key := testKey(1)
+	now := time.Unix(1000, 0)
+
+	b, err := OpenAddressBook(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := net.UDPAddr{IP: NewIPv6(), Port: 1024}
+	if err := ObserveDeclaration(b, NewAddressDeclarationPayload(addr, key), now); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := NewAddressDeclarationPayload(addr, key)
+	bad.Port++
+	if err := ObserveDeclaration(b, bad, now); err == nil {
+		t.Error("expected an invalid declaration to fail")
+	}
+
+	// Only being seen again is saved on close
+	if err := ObserveDeclaration(b, NewAddressDeclarationPayload(addr, key), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenAddressBook(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, ok := b.Lookup(key.Public().(ed25519.PublicKey))
+	if !ok || !r.Addr().IP.Equal(addr.IP) || r.Addrs[0].Source != SourceDeclaration || !r.LastSeen.Equal(now.Add(time.Second)) {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestFileAddressBookFlushDelay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peers.json")
+	b, err := OpenAddressBook(filename, WithFlushDelay(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := b.Observe(testKey(byte(i)).Public().(ed25519.PublicKey), &net.UDPAddr{IP: NewIPv6(), Port: 1024}, SourceDeclaration, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A burst of new peers is saved once, after the delay
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected nothing saved before the delay, got %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	saved, err := OpenAddressBook(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(saved.Peers()); n != 10 {
+		t.Errorf("expected 10 saved peers, got %d", n)
+	}
+}
+
+func TestAddressBookConcurrency(t *testing.T) {
+	b := NewMemoryAddressBook(WithEviction(EvictLeastRecent(4)))
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := testKey(byte(i)).Public().(ed25519.PublicKey)
+			for j := 0; j < 100; j++ {
+				b.Observe(key, &net.UDPAddr{IP: net.ParseIP("ff1e::1"), Port: 1024 + j%3}, SourceDeclaration, now.Add(time.Duration(j)))
+				b.Lookup(key)
+				b.Peers()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(b.Peers()); n > 4 {
+		t.Errorf("expected at most 4 peers, got %d", n)
+	}
+}
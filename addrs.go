@@ -1,9 +1,14 @@
 package mp2p
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"net"
+	"strconv"
+	"time"
 )
 
 // NewPrefixedIPv6 generates a globally routable, unicast-prefixed multicast address with the
@@ -37,22 +42,100 @@ func NewPrefixedIPv6() (ip net.IP, ifi *net.Interface, err error) {
 	return nil, nil, errors.New("no routable ipv6 multicast interface found")
 }
 
+// Scope is the reach of a multicast address, using the ipv6 scope values
+type Scope uint8
+
+const (
+	ScopeLinkLocal         Scope = 0x2
+	ScopeSiteLocal         Scope = 0x5
+	ScopeOrganizationLocal Scope = 0x8
+	ScopeGlobal            Scope = 0xe
+)
+
+func (s Scope) String() string {
+	switch s {
+	case ScopeLinkLocal:
+		return "link-local"
+	case ScopeSiteLocal:
+		return "site-local"
+	case ScopeOrganizationLocal:
+		return "organization-local"
+	case ScopeGlobal:
+		return "global"
+	}
+	return "scope " + strconv.Itoa(int(s))
+}
+
+// HopLimit returns the ttl or hop limit conventionally used to keep packets within the scope
+func (s Scope) HopLimit() int {
+	switch {
+	case s <= ScopeLinkLocal:
+		return 1
+	case s <= ScopeSiteLocal:
+		return 15
+	case s <= ScopeOrganizationLocal:
+		return 63
+	}
+	return defaultHopLimit
+}
+
+// valid reports whether the scope reaches beyond the node, and can be set in an ipv6
+// multicast address
+func (s Scope) valid() bool {
+	return s >= ScopeLinkLocal && s < 0xf
+}
+
+// ScopeOf returns the scope of a multicast address, ipv4 addresses are scoped as in RFC 2365
+func ScopeOf(ip net.IP) Scope {
+	if ip4 := ip.To4(); ip4 != nil {
+		switch {
+		case ip4[0] == 224 && ip4[1] == 0 && ip4[2] == 0:
+			return ScopeLinkLocal
+		case ip4[0] == 239 && ip4[1] == 255:
+			return ScopeSiteLocal
+		case ip4[0] == 239:
+			return ScopeOrganizationLocal
+		}
+		return ScopeGlobal
+	}
+
+	if len(ip) != net.IPv6len || ip[0] != 0xff {
+		return ScopeGlobal
+	}
+	return Scope(ip[1] & 0x0f)
+}
+
 // NewIPv6 generates a random globally routable transient ipv6 multicast address
 func NewIPv6() net.IP {
+	return NewScopedIPv6(ScopeGlobal)
+}
+
+// NewScopedIPv6 generates a random transient ipv6 multicast address of the scope
+func NewScopedIPv6(scope Scope) net.IP {
+	if !scope.valid() {
+		return nil
+	}
+
 	ip, err := randIP(net.IPv6len)
 	if len(ip) != net.IPv6len || err != nil {
 		return nil
 	}
 
-	// Set the global transient multicast bits
-	ip[0], ip[1] = 0xff, 0x1e
-	return ip
+	// Set the transient multicast bits
+	ip[0], ip[1] = 0xff, 0x10|byte(scope)
+	return validGroup(ip)
 }
 
 // NewIPv6FromPrefix generates a globally routable unicast prefixed multicast address with the
 // same prefix as the given net.IPNet
 func NewIPv6FromPrefix(prefix *net.IPNet) net.IP {
-	if prefix == nil || !prefix.IP.IsGlobalUnicast() || prefix.IP.To4() != nil {
+	return NewScopedIPv6FromPrefix(prefix, ScopeGlobal)
+}
+
+// NewScopedIPv6FromPrefix generates a unicast prefixed multicast address of the scope with the
+// same prefix as the given net.IPNet
+func NewScopedIPv6FromPrefix(prefix *net.IPNet, scope Scope) net.IP {
+	if !scope.valid() || prefix == nil || !prefix.IP.IsGlobalUnicast() || prefix.IP.To4() != nil {
 		return nil
 	}
 
@@ -61,28 +144,248 @@ func NewIPv6FromPrefix(prefix *net.IPNet) net.IP {
 		return nil
 	}
 
-	_, maskLen := prefix.Mask.Size()
+	// The plen byte is the length in bits of the prefix in bytes 4 to 11, which hold at most
+	// 64 bits (RFC 3306). Older addresses carry 128 there instead, unicastPrefix reads that as
+	// 64.
+	plen, _ := prefix.Mask.Size()
+	if plen > 64 {
+		plen = 64
+	}
 
-	// Set the global, unicast-prefixed multicast bits
-	ip[0], ip[1], ip[2], ip[3] = 0xff, 0x3e, 0x00, byte(maskLen)
+	// Set the unicast-prefixed multicast bits
+	ip[0], ip[1], ip[2], ip[3] = 0xff, 0x30|byte(scope), 0x00, byte(plen)
 
 	// Copy in the prefix
-	if n := copy(ip[4:12], prefix.IP[:8]); n != 8 {
+	if n := copy(ip[4:12], prefix.IP.Mask(net.CIDRMask(plen, 8*net.IPv6len))[:8]); n != 8 {
+		return nil
+	}
+
+	return validGroup(ip)
+}
+
+// NewEmbeddedRPIPv6 generates a globally routable multicast address embedding the address of
+// its rendezvous point (RFC 3956), so routers in other domains can find the rp. The rp must be
+// the prefix followed by zeros and a non zero 4 bit interface id, and the prefix at most 64
+// bits long.
+func NewEmbeddedRPIPv6(rp net.IP, prefix *net.IPNet) (net.IP, error) {
+	if len(rp) != net.IPv6len || rp.To4() != nil || prefix == nil {
+		return nil, errors.New("rendezvous point must be an ipv6 address with its prefix")
+	}
+
+	plen, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || plen == 0 || plen > 64 {
+		return nil, errors.New("rendezvous point prefix must be 1 to 64 bits long")
+	}
+
+	riid := rp[15] & 0x0f
+	expected := rp.Mask(prefix.Mask)
+	expected[15] |= riid
+	if riid == 0 || !expected.Equal(rp) || !prefix.Contains(rp) {
+		return nil, errors.New("rendezvous point must be its prefix followed by a 4 bit interface id")
+	}
+
+	ip, err := randIP(net.IPv6len)
+	if len(ip) != net.IPv6len || err != nil {
+		return nil, errors.New("failed to generate group id")
+	}
+
+	// Set the global, embedded rp multicast bits
+	ip[0], ip[1], ip[2], ip[3] = 0xff, 0x7e, riid, byte(plen)
+
+	// Copy in the prefix, the group id is the random last 32 bits
+	copy(ip[4:12], rp.Mask(prefix.Mask)[:8])
+
+	if validGroup(ip) == nil {
+		return nil, errors.New("generated an invalid embedded rp address")
+	}
+	return ip, nil
+}
+
+// IsEmbeddedRP reports whether the address is an embedded rp multicast address
+func IsEmbeddedRP(ip net.IP) bool {
+	return EmbeddedRP(ip) != nil
+}
+
+// EmbeddedRP returns the rendezvous point address embedded in an embedded rp multicast
+// address (RFC 3956), or nil for any other address
+func EmbeddedRP(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || ip.To4() != nil || ip[0] != 0xff || ip[1]&0xf0 != 0x70 || ip[2]&0xf0 != 0 {
+		return nil
+	}
+
+	riid, plen := ip[2]&0x0f, int(ip[3])
+	if riid == 0 || plen == 0 || plen > 64 {
+		return nil
+	}
+
+	rp := make(net.IP, net.IPv6len)
+	copy(rp, ip[4:12])
+	rp = rp.Mask(net.CIDRMask(plen, 8*net.IPv6len))
+	rp[15] = riid
+	return rp
+}
+
+// legacyPrefixLen is the plen byte of prefixed addresses generated by earlier versions, the
+// width of the mask rather than of the prefix, covering the 64 bits embedded in the address
+const legacyPrefixLen = 8 * net.IPv6len
+
+// unicastPrefix returns the unicast prefix embedded in a unicast prefix based ipv6 multicast
+// address (RFC 3306) or embedded rp address (RFC 3956), or nil for any other address
+func unicastPrefix(ip net.IP) *net.IPNet {
+	if len(ip) != net.IPv6len || ip.To4() != nil || ip[0] != 0xff || ip[1]&0xb0 != 0x30 {
+		return nil
+	}
+
+	plen := int(ip[3])
+	if plen == legacyPrefixLen && ip[1]&0xf0 == 0x30 {
+		plen = 64
+	}
+	if plen == 0 || plen > 64 {
 		return nil
 	}
 
-	return ip
+	prefix := make(net.IP, net.IPv6len)
+	copy(prefix, ip[4:12])
+	mask := net.CIDRMask(plen, 128)
+	return &net.IPNet{IP: prefix.Mask(mask), Mask: mask}
 }
 
-// NewIPv4 generates a random unassigned ipv4 multicast address
+// NewIPv4 generates a random unassigned ipv4 multicast address, in 224.0.224.0-224.0.249.255
 func NewIPv4() net.IP {
 	ip, err := randIP(net.IPv4len)
 	if len(ip) != net.IPv4len || err != nil {
 		return nil
 	}
 
-	ip[0], ip[2] = 0xe0, ip[2]|0xe0
-	return ip[:]
+	n := binary.BigEndian.Uint16(ip[2:]) % ipv4RangeLen
+	ip[0], ip[1], ip[2], ip[3] = 224, 0, 224+byte(n>>8), byte(n)
+	return validGroup(ip)
+}
+
+// NewAdminScopedIPv4 generates a random administratively scoped ipv4 multicast address
+// (RFC 2365), in 239.255.0.0/16 for the site local scope and 239.192.0.0/14 for the
+// organization local scope. Other scopes have no administrative range.
+func NewAdminScopedIPv4(scope Scope) net.IP {
+	ip, err := randIP(net.IPv4len)
+	if len(ip) != net.IPv4len || err != nil {
+		return nil
+	}
+
+	switch scope {
+	case ScopeSiteLocal:
+		ip[0], ip[1] = 239, 255
+	case ScopeOrganizationLocal:
+		ip[0], ip[1] = 239, 192|ip[1]&0x03
+	default:
+		return nil
+	}
+	return validGroup(ip)
+}
+
+// NewSSMIPv6 generates a random source specific ipv6 multicast address, from the ff3e::/96
+// group ids hosts may allocate dynamically (RFC 4607)
+func NewSSMIPv6() net.IP {
+	ip, err := randIP(net.IPv6len)
+	if len(ip) != net.IPv6len || err != nil {
+		return nil
+	}
+
+	// Only the last 32 bits are random, with the top bit set for dynamic allocation
+	copy(ip, []byte{0xff, 0x3e, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	ip[12] |= 0x80
+	return validGroup(ip)
+}
+
+// NewSSMIPv4 generates a random source specific ipv4 multicast address, outside the reserved
+// 232.0.0.0/24
+func NewSSMIPv4() net.IP {
+	ip, err := randIP(net.IPv4len)
+	if len(ip) != net.IPv4len || err != nil {
+		return nil
+	}
+
+	ip[0] = 232
+	if ip[1] == 0 && ip[2] == 0 {
+		ip[1] = 1
+	}
+	return validGroup(ip)
+}
+
+// KeyEpoch returns the epoch of the time when rotating keyed addresses every period, so
+// peers with loosely synchronised clocks derive the same addresses
+func KeyEpoch(t time.Time, period time.Duration) uint64 {
+	if period <= 0 {
+		return 0
+	}
+	return uint64(t.UnixNano() / int64(period))
+}
+
+// NewKeyedIPv6 derives the globally routable transient ipv6 multicast address of a public key
+// in an epoch, so knowing a peer's key is enough to find it. The epoch is zero when the
+// address doesn't rotate.
+func NewKeyedIPv6(pub ed25519.PublicKey, epoch uint64) net.IP {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil
+	}
+
+	h := keyHash(pub, epoch)
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, h[:])
+
+	// Set the global transient multicast bits
+	ip[0], ip[1] = 0xff, 0x1e
+	return validGroup(ip)
+}
+
+// NewKeyedIPv6FromPrefix derives the globally routable unicast prefixed multicast address of a
+// public key in an epoch, within the given prefix
+func NewKeyedIPv6FromPrefix(pub ed25519.PublicKey, prefix *net.IPNet, epoch uint64) net.IP {
+	return NewScopedKeyedIPv6FromPrefix(pub, prefix, ScopeGlobal, epoch)
+}
+
+// NewScopedKeyedIPv6FromPrefix derives the unicast prefixed multicast address of the scope of
+// a public key in an epoch, within the given prefix
+func NewScopedKeyedIPv6FromPrefix(pub ed25519.PublicKey, prefix *net.IPNet, scope Scope, epoch uint64) net.IP {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil
+	}
+
+	ip := NewScopedIPv6FromPrefix(prefix, scope)
+	if ip == nil {
+		return nil
+	}
+
+	// The group id is the last 32 bits, with the top bit set for dynamic allocation
+	h := keyHash(pub, epoch)
+	copy(ip[12:], h[:4])
+	ip[12] |= 0x80
+	return validGroup(ip)
+}
+
+// NewKeyedIPv4 derives the ipv4 multicast address of a public key in an epoch, from the same
+// range as NewIPv4. There are only a few thousand of these, so collisions are likely in busy
+// networks.
+func NewKeyedIPv4(pub ed25519.PublicKey, epoch uint64) net.IP {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil
+	}
+
+	h := keyHash(pub, epoch)
+	n := binary.BigEndian.Uint16(h[:]) % ipv4RangeLen
+	return validGroup(net.IPv4(224, 0, 224+byte(n>>8), byte(n)).To4())
+}
+
+// ipv4RangeLen is the number of addresses in 224.0.224.0-224.0.249.255
+const ipv4RangeLen = 26 * 256
+
+// keyHash hashes a public key and epoch into the bits of a keyed address
+func keyHash(pub ed25519.PublicKey, epoch uint64) [sha256.Size]byte {
+	b := make([]byte, 0, 10+len(pub)+8)
+	b = append(b, "mp2p group"...)
+	b = append(b, pub...)
+	b = append(b, byte(epoch>>56), byte(epoch>>48), byte(epoch>>40), byte(epoch>>32),
+		byte(epoch>>24), byte(epoch>>16), byte(epoch>>8), byte(epoch))
+	return sha256.Sum256(b)
 }
 
 // randIP generates a random byte slice of the desired length
@@ -1,9 +1,12 @@
 package mp2p
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestAddrs(t *testing.T) {
@@ -52,3 +55,140 @@ func TestAddrs(t *testing.T) {
 
 	}
 }
+
+func TestEmbeddedRP(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:beef:feed::/64")
+	rp := net.ParseIP("2001:db8:beef:feed::3")
+
+	ip, err := NewEmbeddedRPIPv6(rp, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip[0] != 0xff || ip[1] != 0x7e || ip[2] != 3 || ip[3] != 64 {
+		t.Errorf("unexpected embedded rp address %s", ip)
+	}
+	if got := EmbeddedRP(ip); !got.Equal(rp) {
+		t.Errorf("expected rp %s, got %s", rp, got)
+	}
+	if got := unicastPrefix(ip); got.String() != prefix.String() {
+		t.Errorf("expected prefix %s, got %s", prefix, got)
+	}
+
+	// RFC 3956 example, rp 2001:db8:beef:feed::7 in ff7e:0740:2001:db8:beef:feed::/96
+	if got := EmbeddedRP(net.ParseIP("ff7e:740:2001:db8:beef:feed::1234")); !got.Equal(net.ParseIP("2001:db8:beef:feed::7")) {
+		t.Errorf("expected rp 2001:db8:beef:feed::7, got %s", got)
+	}
+
+	for _, rp := range []string{"2001:db8:beef:feed::", "2001:db8:beef:feed::17", "2001:db8:beef:fee0::3", "192.0.2.3"} {
+		if _, err := NewEmbeddedRPIPv6(net.ParseIP(rp), prefix); err == nil {
+			t.Errorf("expected rp %s to be rejected", rp)
+		}
+	}
+
+	for _, ip := range []string{"ff1e::1", "ff3e:40:2001:db8::1", "ff7e:40:2001:db8::1", "224.0.250.1"} {
+		if IsEmbeddedRP(net.ParseIP(ip)) {
+			t.Errorf("expected %s not to be embedded rp", ip)
+		}
+	}
+}
+
+func TestScopedAddrs(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::10/64")
+
+	for _, scope := range []Scope{ScopeLinkLocal, ScopeSiteLocal, ScopeOrganizationLocal, ScopeGlobal} {
+		ip := NewScopedIPv6(scope)
+		if ip[1] != 0x10|byte(scope) || ScopeOf(ip) != scope {
+			t.Errorf("expected transient %s address, got %s", scope, ip)
+		}
+
+		ip = NewScopedIPv6FromPrefix(prefix, scope)
+		if ip[1] != 0x30|byte(scope) || ScopeOf(ip) != scope {
+			t.Errorf("expected prefixed %s address, got %s", scope, ip)
+		}
+		if got := unicastPrefix(ip); got.String() != prefix.String() {
+			t.Errorf("expected prefix %s, got %s", prefix, got)
+		}
+	}
+
+	if ip := NewScopedIPv6(0xf); ip != nil {
+		t.Errorf("expected reserved scope to fail, got %s", ip)
+	}
+
+	for _, scope := range []Scope{ScopeSiteLocal, ScopeOrganizationLocal} {
+		if ip := NewAdminScopedIPv4(scope); ip[0] != 239 || ScopeOf(ip) != scope {
+			t.Errorf("expected %s address, got %s", scope, ip)
+		}
+	}
+	if ip := NewAdminScopedIPv4(ScopeGlobal); ip != nil {
+		t.Errorf("expected no global administrative scope, got %s", ip)
+	}
+
+	tests := []struct {
+		ip   string
+		hops int
+	}{
+		{"ff12::1", 1}, {"ff35:40:2001:db8::1", 15}, {"ff18::1", 63}, {"ff1e::1", 255},
+		{"224.0.0.251", 1}, {"239.255.1.1", 15}, {"239.192.1.1", 63}, {"224.0.250.1", 255},
+	}
+	for _, test := range tests {
+		cfg := newConnConfig(nil)
+		cfg.scope(net.ParseIP(test.ip))
+		if cfg.ttl != test.hops || cfg.hopLimit != test.hops {
+			t.Errorf("expected %s to use %d hops, got %d and %d", test.ip, test.hops, cfg.ttl, cfg.hopLimit)
+		}
+	}
+
+	// Explicit hops are kept, even 0
+	cfg := newConnConfig([]ConnOption{WithTTL(0), WithHopLimit(0)})
+	cfg.scope(net.ParseIP("ff1e::1"))
+	if cfg.ttl != 0 || cfg.hopLimit != 0 {
+		t.Errorf("expected 0 hops to be kept, got %d and %d", cfg.ttl, cfg.hopLimit)
+	}
+}
+
+func TestKeyedAddrs(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::10/64")
+
+	gens := map[string]func(pub ed25519.PublicKey, epoch uint64) net.IP{
+		"ipv6": NewKeyedIPv6,
+		"ipv4": NewKeyedIPv4,
+		"prefixed": func(pub ed25519.PublicKey, epoch uint64) net.IP {
+			return NewKeyedIPv6FromPrefix(pub, prefix, epoch)
+		},
+	}
+
+	for name, gen := range gens {
+		ip := gen(pub, 0)
+		if !ip.IsMulticast() || !ip.Equal(gen(pub, 0)) {
+			t.Errorf("%s: expected a stable multicast address, got %s", name, ip)
+		}
+		if ip.Equal(gen(pub, 1)) || ip.Equal(gen(other, 0)) {
+			t.Errorf("%s: expected the address to depend on the key and epoch", name)
+		}
+		if gen(pub[:8], 0) != nil {
+			t.Errorf("%s: expected short keys to fail", name)
+		}
+	}
+
+	if ip := NewKeyedIPv6FromPrefix(pub, prefix, 0); unicastPrefix(ip).String() != prefix.String() {
+		t.Errorf("expected prefix %s, got %s", prefix, ip)
+	}
+	if ip := NewScopedKeyedIPv6FromPrefix(pub, prefix, ScopeSiteLocal, 0); ScopeOf(ip) != ScopeSiteLocal || !ip[12:].Equal(NewKeyedIPv6FromPrefix(pub, prefix, 0)[12:]) {
+		t.Errorf("expected a site scoped address with the same group id, got %s", ip)
+	}
+
+	for i := 0; i < 100; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		if ip := NewKeyedIPv4(pub, 0); ip[0] != 224 || ip[1] != 0 || ip[2] < 224 || ip[2] > 249 {
+			t.Fatalf("expected address in 224.0.224.0-224.0.249.255, got %s", ip)
+		}
+	}
+
+	period := time.Hour
+	now := time.Unix(1700000000, 0)
+	if KeyEpoch(now, period) != KeyEpoch(now.Add(time.Second), period) || KeyEpoch(now, period) == KeyEpoch(now.Add(period), period) {
+		t.Error("expected epochs to change once per period")
+	}
+}
@@ -0,0 +1,88 @@
+// Command mp2p manages the known peers file clients trust peer keys with
+//
+//	mp2p known list
+//	mp2p known pin <peer uri>
+//	mp2p known remove <group:port | peer uri | hashed name>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jreamy/mp2p"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "known":
+		known(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mp2p known [-file known_peers] [-hash] list | pin <peer uri> | remove <group:port | peer uri | hashed name>")
+	os.Exit(2)
+}
+
+func known(args []string) {
+	defaultFile, _ := mp2p.DefaultKnownPeersFile()
+
+	flags := flag.NewFlagSet("known", flag.ExitOnError)
+	file := flags.String("file", defaultFile, "known peers file")
+	hash := flags.Bool("hash", false, "hash the names of pinned peers")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	peers, err := mp2p.OpenKnownPeers(*file, mp2p.WithHashedNames(*hash))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cmd, args := flags.Arg(0), flags.Args()[1:]; {
+	case cmd == "list" && len(args) == 0:
+		for _, p := range peers.Peers() {
+			fmt.Println(p)
+		}
+
+	case cmd == "pin" && len(args) == 1:
+		p, err := mp2p.ParsePeerURI(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := peers.Pin(mp2p.KnownPeerName(p.Addr), p.Key); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("pinned %s\n", mp2p.KnownPeerName(p.Addr))
+
+	case cmd == "remove" && len(args) == 1:
+		name := args[0]
+		if p, err := mp2p.ParsePeerURI(name); err == nil {
+			name = mp2p.KnownPeerName(p.Addr)
+		}
+
+		n, err := peers.Remove(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n == 0 {
+			log.Fatalf("no entry for %s", name)
+		}
+		fmt.Printf("removed %d entries for %s\n", n, name)
+
+	default:
+		usage()
+	}
+}
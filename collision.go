@@ -0,0 +1,325 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// CollisionError is returned when another identity is using a node's group
+type CollisionError struct {
+	Group net.IP
+
+	// Key is the other identity, nil when the traffic doesn't reveal it
+	Key ed25519.PublicKey
+}
+
+func (e *CollisionError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("group %s is in use by another node", e.Group)
+	}
+	return fmt.Sprintf("group %s is in use by %x", e.Group, []byte(e.Key))
+}
+
+// ProbeGroup listens on the connection's group for the duration, returning a CollisionError
+// if another identity declares the group or is sent session initiations on it, by the same
+// rules as CollisionDetector. Other traffic, such as peers declaring their own groups here,
+// doesn't mean the group is taken. A fresh group is cheap to give up, so a single message is
+// enough evidence.
+func ProbeGroup(conn PacketConn, self ed25519.PublicKey, d time.Duration) error {
+	detector := NewCollisionDetector(self, groupIP(conn), WithCollisionEvidence(1, 0))
+	if err := conn.SetDeadline(time.Now().Add(d)); err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, conn.MTU())
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		msg, err := ParseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if err := detector.Observe(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// CollisionDetector notices other identities using a node's group at runtime, from the
+// messages arriving on it.
+//
+// Anyone can sign a declaration or session initiation, so a single message isn't taken as
+// proof. A collision is only reported once several different messages naming the same
+// identity have arrived over a span of time, replays of one message count once.
+type CollisionDetector struct {
+	self     ed25519.PublicKey
+	evidence int
+	span     time.Duration
+
+	mu        sync.Mutex
+	group     net.IP
+	sightings map[string]*sighting
+}
+
+// sighting is the evidence seen of another identity using the group
+type sighting struct {
+	first time.Time
+	sigs  map[[ed25519.SignatureSize]byte]bool
+}
+
+// maxSightings bounds the identities tracked, the oldest is dropped to make room
+const maxSightings = 64
+
+// CollisionOption configures optional CollisionDetector behaviour
+type CollisionOption func(*CollisionDetector)
+
+// WithCollisionEvidence sets how many different messages naming another identity must arrive,
+// over at least the span, before a collision is reported. By default 3 over 10 seconds.
+func WithCollisionEvidence(n int, span time.Duration) CollisionOption {
+	return func(d *CollisionDetector) {
+		d.evidence, d.span = n, span
+	}
+}
+
+// NewCollisionDetector detects collisions on the group of the identity
+func NewCollisionDetector(self ed25519.PublicKey, group net.IP, opts ...CollisionOption) *CollisionDetector {
+	d := &CollisionDetector{
+		self:      self,
+		evidence:  3,
+		span:      10 * time.Second,
+		group:     group,
+		sightings: make(map[string]*sighting),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Group returns the group being watched
+func (d *CollisionDetector) Group() net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.group
+}
+
+// SetGroup watches a new group, after the node moved to it, forgetting the evidence seen on
+// the old one
+func (d *CollisionDetector) SetGroup(group net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.group = group
+	d.sightings = make(map[string]*sighting)
+}
+
+// Observe checks a message received on the group, returning a CollisionError once there is
+// enough evidence of another identity declaring the group as its own, or of session
+// initiations arriving for another identity
+func (d *CollisionDetector) Observe(msg Message) error {
+	group := d.Group()
+
+	switch x := msg.(type) {
+	case AddressDeclarationPayload:
+		if net.IP(x.Address[:]).Equal(group) && !bytes.Equal(x.Src[:], d.self) && x.Validate() {
+			return d.sighted(group, x.Src[:], x.Signature)
+		}
+	case SessionInitiationPayload:
+		if !bytes.Equal(x.Dst[:], d.self) && x.Validate() {
+			return d.sighted(group, x.Dst[:], x.Signature)
+		}
+	}
+	return nil
+}
+
+// sighted records a message naming another identity, returning a CollisionError once there
+// is enough evidence
+func (d *CollisionDetector) sighted(group net.IP, key []byte, sig [ed25519.SignatureSize]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	s, ok := d.sightings[string(key)]
+	if !ok {
+		if len(d.sightings) >= maxSightings {
+			d.forgetOldest()
+		}
+		s = &sighting{first: now, sigs: make(map[[ed25519.SignatureSize]byte]bool)}
+		d.sightings[string(key)] = s
+	}
+
+	if len(s.sigs) < d.evidence {
+		s.sigs[sig] = true
+	}
+	if len(s.sigs) < d.evidence || now.Sub(s.first) < d.span {
+		return nil
+	}
+
+	delete(d.sightings, string(key))
+	return &CollisionError{Group: group, Key: append(ed25519.PublicKey(nil), key...)}
+}
+
+func (d *CollisionDetector) forgetOldest() {
+	var oldest string
+	var first time.Time
+	for k, s := range d.sightings {
+		if first.IsZero() || s.first.Before(first) {
+			oldest, first = k, s.first
+		}
+	}
+	delete(d.sightings, oldest)
+}
+
+// Allocator picks groups for a node, avoiding groups other identities are using
+type Allocator struct {
+	// Key is the node's identity
+	Key ed25519.PublicKey
+
+	// Generate returns candidate groups, such as NewIPv4
+	Generate func() net.IP
+
+	// Port is the port to listen on
+	Port int
+
+	// ProbeTime is how long each candidate is listened to, 2 seconds by default
+	ProbeTime time.Duration
+
+	// Attempts is how many candidates are tried, 5 by default
+	Attempts int
+
+	// Options configure the connections
+	Options []ConnOption
+
+	// Open opens a connection on a candidate group, such as NewMultiConn, NewConn with no
+	// interface by default
+	Open func(group net.IP, port int, opts ...ConnOption) (PacketConn, error)
+
+	// MinInterval is the least time between relocations, so a node flooded with collisions
+	// doesn't keep moving, a minute by default
+	MinInterval time.Duration
+
+	mu        sync.Mutex
+	relocated time.Time
+}
+
+var (
+	// ErrNoGroup is returned when every candidate group was in use
+	ErrNoGroup = errors.New("no free group found")
+
+	// ErrRelocateTooSoon is returned when relocating again within the allocator's MinInterval
+	ErrRelocateTooSoon = errors.New("relocated too recently")
+)
+
+// Listen returns a connection on a generated group no other identity appears to be using
+func (a *Allocator) Listen() (PacketConn, error) {
+	attempts := a.Attempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+
+	for i := 0; i < attempts; i++ {
+		group := a.Generate()
+		if group == nil {
+			return nil, errors.New("failed to generate group")
+		}
+
+		conn, err := a.probe(group)
+		if err == nil {
+			return conn, nil
+		}
+
+		var collision *CollisionError
+		if !errors.As(err, &collision) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoGroup
+}
+
+// probe listens on the group, returning the connection if no other identity is using it
+func (a *Allocator) probe(group net.IP) (PacketConn, error) {
+	probeTime, open := a.ProbeTime, a.Open
+	if probeTime <= 0 {
+		probeTime = 2 * time.Second
+	}
+	if open == nil {
+		open = func(group net.IP, port int, opts ...ConnOption) (PacketConn, error) {
+			return NewConn(nil, group, port, opts...)
+		}
+	}
+
+	conn, err := open(group, a.Port, a.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ProbeGroup(conn, a.Key, probeTime); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Relocate moves a node off a colliding group, listening on a newly allocated group which the
+// detector then watches. Announce is called with the new connection so the node can declare
+// its new address to its peers, the old connection is left for the caller to close. Within
+// MinInterval of the last relocation it fails with ErrRelocateTooSoon.
+func (a *Allocator) Relocate(d *CollisionDetector, announce func(conn PacketConn) error) (PacketConn, error) {
+	minInterval := a.MinInterval
+	if minInterval <= 0 {
+		minInterval = time.Minute
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.relocated.IsZero() && time.Since(a.relocated) < minInterval {
+		return nil, ErrRelocateTooSoon
+	}
+
+	conn, err := a.Listen()
+	if err != nil {
+		return nil, err
+	}
+	a.relocated = time.Now()
+	return conn, moved(d, conn, announce)
+}
+
+// Move moves a node to the given group, such as one in its new unicast prefix after
+// renumbering, probing it first like Listen. The detector and announce are used as in
+// Relocate.
+func (a *Allocator) Move(d *CollisionDetector, group net.IP, announce func(conn PacketConn) error) (PacketConn, error) {
+	conn, err := a.probe(group)
+	if err != nil {
+		return nil, err
+	}
+	return conn, moved(d, conn, announce)
+}
+
+// moved watches the new connection's group and announces it
+func moved(d *CollisionDetector, conn PacketConn, announce func(conn PacketConn) error) error {
+	d.SetGroup(groupIP(conn))
+	if announce != nil {
+		if err := announce(conn); err != nil {
+			return fmt.Errorf("failed to announce new group: %w", err)
+		}
+	}
+	return nil
+}
+
+// groupIP returns the ip of the connection's group
+func groupIP(conn PacketConn) net.IP {
+	if addr, ok := conn.Group().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+func TestProbeGroup(t *testing.T) {
+	self, other := testKey(1), testKey(2)
+
+	a, b := newMemConnPair(1452, 1452)
+	if err := ProbeGroup(b, self.Public().(ed25519.PublicKey), 10*time.Millisecond); err != nil {
+		t.Fatalf("expected a quiet group, got %v", err)
+	}
+
+	// The node's own declarations don't count
+	a.WriteTo(NewAddressDeclarationPayload(net.UDPAddr{IP: b.addr.IP, Port: 1024}, self).Bytes(), b.addr)
+	if err := ProbeGroup(b, self.Public().(ed25519.PublicKey), 10*time.Millisecond); err != nil {
+		t.Fatalf("expected own traffic to be ignored, got %v", err)
+	}
+
+	// Peers declaring their own groups here, and session data, don't claim the group
+	a.WriteTo(NewAddressDeclarationPayload(net.UDPAddr{IP: a.addr.IP, Port: 1024}, other).Bytes(), b.addr)
+	a.WriteTo(SessionDataPayload{MessageType: TypeSessionData, Data: []byte("data")}.Bytes(), b.addr)
+	if err := ProbeGroup(b, self.Public().(ed25519.PublicKey), 10*time.Millisecond); err != nil {
+		t.Fatalf("expected other traffic to be ignored, got %v", err)
+	}
+
+	a.WriteTo(NewAddressDeclarationPayload(net.UDPAddr{IP: b.addr.IP, Port: 1024}, other).Bytes(), b.addr)
+	var collision *CollisionError
+	if err := ProbeGroup(b, self.Public().(ed25519.PublicKey), time.Second); !errors.As(err, &collision) {
+		t.Fatalf("expected a collision, got %v", err)
+	}
+	if !bytes.Equal(collision.Key, other.Public().(ed25519.PublicKey)) {
+		t.Errorf("expected the other key, got %x", []byte(collision.Key))
+	}
+}
+
+func TestCollisionDetector(t *testing.T) {
+	self, other, client := testKey(1), testKey(2), testKey(3)
+	group := NewIPv4()
+	d := NewCollisionDetector(self.Public().(ed25519.PublicKey), group, WithCollisionEvidence(1, 0))
+
+	// Clients declare their own groups, and initiate sessions with the node
+	init, _, _ := NewSessionInitiationPayload(client, self.Public().(ed25519.PublicKey), nil)
+	for _, msg := range []Message{
+		NewAddressDeclarationPayload(net.UDPAddr{IP: NewIPv4(), Port: 1024}, client),
+		NewAddressDeclarationPayload(net.UDPAddr{IP: group, Port: 1024}, self),
+		init,
+	} {
+		if err := d.Observe(msg); err != nil {
+			t.Errorf("expected no collision for %T, got %v", msg, err)
+		}
+	}
+
+	init, _, _ = NewSessionInitiationPayload(client, other.Public().(ed25519.PublicKey), nil)
+	for _, msg := range []Message{
+		NewAddressDeclarationPayload(net.UDPAddr{IP: group, Port: 1024}, other),
+		init,
+	} {
+		var collision *CollisionError
+		if err := d.Observe(msg); !errors.As(err, &collision) || !bytes.Equal(collision.Key, other.Public().(ed25519.PublicKey)) {
+			t.Errorf("expected a collision with the other key for %T, got %v", msg, err)
+		}
+	}
+}
+
+func TestCollisionDetectorEvidence(t *testing.T) {
+	self, other, client := testKey(1), testKey(2), testKey(3)
+	group := NewIPv4()
+	d := NewCollisionDetector(self.Public().(ed25519.PublicKey), group, WithCollisionEvidence(3, 0))
+
+	// Replays of one message are a single piece of evidence
+	decl := NewAddressDeclarationPayload(net.UDPAddr{IP: group, Port: 1024}, other)
+	for i := 0; i < 5; i++ {
+		if err := d.Observe(decl); err != nil {
+			t.Fatalf("expected a replayed declaration not to be enough, got %v", err)
+		}
+	}
+
+	init, _, _ := NewSessionInitiationPayload(client, other.Public().(ed25519.PublicKey), nil)
+	if err := d.Observe(init); err != nil {
+		t.Fatalf("expected two messages not to be enough, got %v", err)
+	}
+	init, _, _ = NewSessionInitiationPayload(client, other.Public().(ed25519.PublicKey), nil)
+	var collision *CollisionError
+	if err := d.Observe(init); !errors.As(err, &collision) {
+		t.Fatalf("expected a collision after three messages, got %v", err)
+	}
+
+	// The evidence must also span some time
+	d = NewCollisionDetector(self.Public().(ed25519.PublicKey), group, WithCollisionEvidence(2, time.Hour))
+	for i := 0; i < 3; i++ {
+		init, _, _ := NewSessionInitiationPayload(client, other.Public().(ed25519.PublicKey), nil)
+		if err := d.Observe(init); err != nil {
+			t.Fatalf("expected a burst of messages not to be enough, got %v", err)
+		}
+	}
+}
+
+func TestAllocatorRelocate(t *testing.T) {
+	self, other := testKey(1), testKey(2)
+
+	// The first candidate is busy, the second is free
+	busy, free := net.ParseIP("224.0.230.1").To4(), net.ParseIP("224.0.230.2").To4()
+	candidates := []net.IP{busy, free}
+
+	a := &Allocator{
+		Key:       self.Public().(ed25519.PublicKey),
+		ProbeTime: 10 * time.Millisecond,
+		Generate: func() net.IP {
+			ip := candidates[0]
+			candidates = candidates[1:]
+			return ip
+		},
+		Open: func(group net.IP, port int, opts ...ConnOption) (PacketConn, error) {
+			a, b := newMemConnPair(1452, 1452)
+			b.addr.IP = group
+			if group.Equal(busy) {
+				a.WriteTo(NewAddressDeclarationPayload(net.UDPAddr{IP: group, Port: port}, other).Bytes(), b.addr)
+			}
+			return b, nil
+		},
+	}
+
+	d := NewCollisionDetector(a.Key, busy)
+	var announced net.IP
+	conn, err := a.Relocate(d, func(conn PacketConn) error {
+		announced = groupIP(conn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !d.Group().Equal(free) || !announced.Equal(free) {
+		t.Errorf("expected to move to %s, watching %s and announced %s", free, d.Group(), announced)
+	}
+
+	// Relocating again straight away is refused
+	if _, err := a.Relocate(d, nil); err != ErrRelocateTooSoon {
+		t.Errorf("expected ErrRelocateTooSoon, got %v", err)
+	}
+
+	// Moving to a given group probes it too
+	var collision *CollisionError
+	if _, err := a.Move(d, busy, nil); !errors.As(err, &collision) || !d.Group().Equal(free) {
+		t.Errorf("expected moving to a busy group to fail, got %v watching %s", err, d.Group())
+	}
+
+	next := net.ParseIP("224.0.230.3").To4()
+	moved, err := a.Move(d, next, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Close()
+
+	if !d.Group().Equal(next) {
+		t.Errorf("expected to move to %s, watching %s", next, d.Group())
+	}
+}
@@ -0,0 +1,182 @@
+package mp2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// CompressionAlgorithm identifies how session data is compressed before it is encrypted
+type CompressionAlgorithm uint8
+
+const (
+	CompressionNone CompressionAlgorithm = iota
+	CompressionDeflate
+)
+
+// maxDecompressedLen bounds the data a single compressed frame may expand to
+const maxDecompressedLen = 1 << 16
+
+// compressionLevel is the cheapest level which still matches datagram sized input against the
+// preset dictionary, the faster levels of compress/flate ignore it for short input
+const compressionLevel = 7
+
+// compressionOfferLen is the algorithm and dictionary id sent to agree on compression,
+// followed by an optional flags byte
+const compressionOfferLen = 1 + 8
+
+// offerAccepted flags offers from a session which has received the peer's offer
+const offerAccepted = 0x01
+
+// WithCompression compresses session data before it is encrypted, using a preset dictionary
+// if dict is not empty. Compression only starts once the peer has offered the same algorithm
+// and dictionary, until then data is sent uncompressed.
+//
+// Compressing secrets alongside attacker controlled data leaks the secrets through the length
+// of the ciphertext (as in the CRIME and BREACH attacks), and anyone can observe lengths on a
+// multicast group. Only enable compression for data that doesn't mix the two, and prefer
+// combining it with a padding policy.
+func WithCompression(alg CompressionAlgorithm, dict []byte) SessionOption {
+	return func(s *Session) {
+		if alg == CompressionNone {
+			s.compression = nil
+			return
+		}
+
+		c := &compression{alg: alg, dict: dict}
+		sum := sha256.Sum256(dict)
+		copy(c.id[:], sum[:])
+		s.compression = c
+	}
+}
+
+type compression struct {
+	alg  CompressionAlgorithm
+	dict []byte
+	id   [8]byte
+
+	// writers holds flate writers primed with the dictionary, which Reset keeps
+	writers sync.Pool
+
+	mu       sync.Mutex
+	accepted bool
+
+	// confirmed is set once the peer has shown it received this session's offer
+	confirmed bool
+}
+
+// compress returns b compressed if the peer accepts compression and it makes b smaller
+func (c *compression) compress(b []byte) ([]byte, bool) {
+	c.mu.Lock()
+	accepted := c.accepted
+	c.mu.Unlock()
+
+	if !accepted {
+		return b, false
+	}
+
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriterDict(&buf, compressionLevel, c.dict); err != nil {
+			return b, false
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(b); err != nil {
+		return b, false
+	}
+	if err := w.Close(); err != nil {
+		return b, false
+	}
+
+	if buf.Len() >= len(b) {
+		return b, false
+	}
+	return buf.Bytes(), true
+}
+
+func (c *compression) decompress(b []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(b), c.dict)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress session data: %w", err)
+	}
+
+	if len(data) > maxDecompressedLen {
+		return nil, errors.New("decompressed session data too large")
+	}
+	return data, nil
+}
+
+func (c *compression) offer(accepted bool) []byte {
+	b := append([]byte{byte(c.alg)}, c.id[:]...)
+	if accepted {
+		return append(b, offerAccepted)
+	}
+	return append(b, 0)
+}
+
+// offerCompression tells the peer which compression this session accepts. Offers can be
+// lost like any datagram, so one goes out with every write until the peer shows it arrived.
+func (s *Session) offerCompression() error {
+	c := s.compression
+
+	c.mu.Lock()
+	confirmed, accepted := c.confirmed, c.accepted
+	c.mu.Unlock()
+
+	if confirmed {
+		return nil
+	}
+	return s.send(frameCompression, c.offer(accepted))
+}
+
+// receiveCompressionOffer agrees on compression if the peer offers the same algorithm and
+// dictionary, answering with an offer until the peer has seen this session accept
+func (s *Session) receiveCompressionOffer(body []byte) error {
+	if len(body) < compressionOfferLen {
+		return errors.New("short compression offer")
+	}
+
+	c := s.compression
+	if c == nil || !bytes.Equal(body[:compressionOfferLen], c.offer(false)[:compressionOfferLen]) {
+		return nil
+	}
+	peerAccepted := len(body) > compressionOfferLen && body[compressionOfferLen]&offerAccepted != 0
+
+	c.mu.Lock()
+	c.accepted = true
+	c.confirmed = c.confirmed || peerAccepted
+	c.mu.Unlock()
+
+	if peerAccepted {
+		return nil
+	}
+	return s.send(frameCompression, c.offer(true))
+}
+
+func (s *Session) decompress(b []byte) ([]byte, error) {
+	c := s.compression
+	if c == nil {
+		return nil, errors.New("compressed session data without compression enabled")
+	}
+
+	// Only a peer which received this session's offer compresses
+	c.mu.Lock()
+	c.confirmed = true
+	c.mu.Unlock()
+
+	return c.decompress(b)
+}
@@ -0,0 +1,134 @@
+package mp2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+// handleNext handles the next datagram waiting on the conn with the session
+func handleNext(t *testing.T, c *memConn, s *Session) ([]byte, int) {
+	p := <-c.reads
+	payload, err := ParseSessionDataPayload(p.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.Handle(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, len(p.data)
+}
+
+func TestCompression(t *testing.T) {
+	msg := bytes.Repeat([]byte(`{"temperature": 21.5, "humidity": 40}`), 10)
+
+	a, b := newMemConnPair(1452, 1452)
+	sa, sb := newSessionPair(t, a, b, WithCompression(CompressionDeflate, []byte(`"temperature""humidity"`)))
+
+	// The first write offers compression and goes out uncompressed
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := handleNext(t, b, sb); data != nil {
+		t.Fatalf("expected compression offer, got data %q", data)
+	}
+	if data, n := handleNext(t, b, sb); !bytes.Equal(data, msg) || n <= len(msg) {
+		t.Fatalf("expected uncompressed message, got %d bytes", n)
+	}
+
+	// The peer offers compression back
+	if data, _ := handleNext(t, a, sa); data != nil {
+		t.Fatalf("expected compression offer, got data %q", data)
+	}
+
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if data, n := handleNext(t, b, sb); !bytes.Equal(data, msg) || n >= len(msg) {
+		t.Fatalf("expected compressed message, got %d bytes", n)
+	}
+}
+
+func TestCompressionNotOffered(t *testing.T) {
+	msg := bytes.Repeat([]byte("compressible "), 20)
+
+	a, b := newMemConnPair(1452, 1452)
+	sa, _ := newSessionPair(t, a, b, WithCompression(CompressionDeflate, nil))
+	_, sb := newSessionPair(t, a, b)
+
+	// Without an answer the offer is repeated with every write
+	for i := 0; i < 2; i++ {
+		if _, err := sa.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := handleNext(t, b, sb); data != nil {
+			t.Fatalf("expected compression offer, got data %q", data)
+		}
+		if data, n := handleNext(t, b, sb); !bytes.Equal(data, msg) || n <= len(msg) {
+			t.Fatalf("expected uncompressed message, got %d bytes", n)
+		}
+	}
+}
+
+func TestCompressionOfferLost(t *testing.T) {
+	msg := bytes.Repeat([]byte(`{"temperature": 21.5, "humidity": 40}`), 10)
+
+	a, b := newMemConnPair(1452, 1452)
+	sa, sb := newSessionPair(t, a, b, WithCompression(CompressionDeflate, nil))
+
+	// The first offer is lost
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	<-b.reads
+	handleNext(t, b, sb)
+
+	// The offer is sent again, and the answer confirms it arrived
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	handleNext(t, b, sb)
+	handleNext(t, b, sb)
+	handleNext(t, a, sa)
+
+	if _, err := sa.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if data, n := handleNext(t, b, sb); !bytes.Equal(data, msg) || n >= len(msg) {
+		t.Fatalf("expected compressed message without another offer, got %d bytes", n)
+	}
+
+	// Compressed data shows the other side's offer arrived too
+	if _, err := sb.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if data, n := handleNext(t, a, sa); !bytes.Equal(data, msg) || n >= len(msg) {
+		t.Fatalf("expected compressed message without an offer, got %d bytes", n)
+	}
+}
+
+func TestCompressionReusesWriters(t *testing.T) {
+	dict := []byte(`{"temperature": 20.0, "humidity": 50}`)
+	c := &compression{alg: CompressionDeflate, dict: dict, accepted: true}
+
+	// Pooled writers are reset between datagrams but must keep the dictionary
+	for _, msg := range []string{
+		`{"temperature": 21.5, "humidity": 40}`,
+		`{"temperature": 19.0, "humidity": 55}`,
+		`{"temperature": 22.5, "humidity": 41}`,
+	} {
+		b, ok := c.compress([]byte(msg))
+		if !ok {
+			t.Fatalf("expected %q to compress", msg)
+		}
+
+		got, err := c.decompress(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("expected %q, got %q", msg, got)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mp2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CoverTraffic configures a session to send fixed size frames at a constant rate, filling idle
+// slots with dummy frames so observers of the multicast group can't tell when the session is
+// actually in use
+type CoverTraffic struct {
+	// FrameSize is the size of every datagram sent, zero uses the path mtu and follows it as
+	// path mtu discovery raises it
+	FrameSize int
+
+	// Bandwidth is the budget in bytes per second spent on the session, which sets the rate
+	Bandwidth int
+
+	// QueueLen is how many frames can wait for a slot before Write blocks, zero defaults to 16
+	QueueLen int
+}
+
+// WithCoverTraffic sends all session frames at the constant rate set by the configuration
+func WithCoverTraffic(c CoverTraffic) SessionOption {
+	return func(s *Session) {
+		s.cover = &coverTraffic{CoverTraffic: c}
+	}
+}
+
+// minCoverFrameSize is the smallest frame that fits the session overhead and padding trailer
+const minCoverFrameSize = sessionOverhead + padTrailerLen
+
+type frame struct {
+	kind uint8
+	body []byte
+}
+
+type coverTraffic struct {
+	CoverTraffic
+
+	queue chan frame
+	done  chan struct{}
+	once  sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *coverTraffic) start(s *Session) error {
+	if c.Bandwidth <= 0 {
+		return errors.New("cover traffic bandwidth must be positive")
+	}
+	if c.FrameSize < 0 {
+		return errors.New("cover traffic frame size must not be negative")
+	}
+	if c.FrameSize > 0 && c.FrameSize < minCoverFrameSize {
+		return fmt.Errorf("cover traffic frame size must be at least %d", minCoverFrameSize)
+	}
+	if c.QueueLen <= 0 {
+		c.QueueLen = 16
+	}
+
+	interval := c.interval(s.PMTU())
+	if interval <= 0 {
+		return errors.New("cover traffic bandwidth is too high")
+	}
+
+	c.queue = make(chan frame, c.QueueLen)
+	c.done = make(chan struct{})
+
+	go c.run(s, interval)
+	return nil
+}
+
+// interval is the time between frames that keeps to the bandwidth at the path mtu
+func (c *coverTraffic) interval(pmtu int) time.Duration {
+	return time.Duration(c.pad(0, pmtu)) * time.Second / time.Duration(c.Bandwidth)
+}
+
+// pad is the padding policy of cover traffic, every frame is the configured size
+func (c *coverTraffic) pad(size, pmtu int) int {
+	if c.FrameSize == 0 || c.FrameSize > pmtu {
+		return pmtu
+	}
+	return c.FrameSize
+}
+
+// enqueue waits for room to queue the frame, returning the last transmit error if any
+func (c *coverTraffic) enqueue(kind uint8, body []byte) error {
+	c.mu.Lock()
+	err := c.err
+	c.err = nil
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case c.queue <- frame{kind: kind, body: append([]byte(nil), body...)}:
+		return nil
+	case <-c.done:
+		return ErrSessionClosed
+	}
+}
+
+func (c *coverTraffic) run(s *Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		// Frames grow with the path mtu, so the rate drops to stay within the bandwidth
+		if next := c.interval(s.PMTU()); next != interval && next > 0 {
+			interval = next
+			ticker.Reset(interval)
+		}
+
+		f := frame{kind: frameDummy}
+		select {
+		case f = <-c.queue:
+		default:
+		}
+
+		// A probe too large for the path just goes unacknowledged, it isn't a write error
+		if err := s.transmit(f.kind, f.body); err != nil && f.kind != frameProbe {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *coverTraffic) stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
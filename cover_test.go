@@ -0,0 +1,111 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCoverTraffic(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	sa, sb := newSessionPair(t, a, b, WithCoverTraffic(CoverTraffic{FrameSize: 300, Bandwidth: 300 * 1000}))
+	defer sa.Close()
+
+	if _, err := sa.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(time.Second)
+	var data, dummies int
+	for data == 0 || dummies == 0 {
+		var p pkt
+		select {
+		case p = <-b.reads:
+		case <-timeout:
+			t.Fatalf("received %d data and %d dummy frames", data, dummies)
+		}
+
+		if len(p.data) != 300 {
+			t.Fatalf("expected constant frame size 300, got %d", len(p.data))
+		}
+
+		payload, err := ParseSessionDataPayload(p.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := sb.Handle(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got == nil {
+			dummies++
+		} else if string(got) != "hello" {
+			t.Fatalf("expected hello, got %q", got)
+		} else {
+			data++
+		}
+	}
+
+	if err := sa.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Write([]byte("hello")); err != ErrSessionClosed {
+		t.Errorf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestCoverTrafficProbe(t *testing.T) {
+	// A slot a second, so nothing leaves while the test looks at the queue
+	a, b := newMemConnPair(1452, 1400)
+	sa, _ := newSessionPair(t, a, b, WithCoverTraffic(CoverTraffic{FrameSize: 300, Bandwidth: 300}))
+	defer sa.Close()
+
+	if err := sa.send(frameProbe, make([]byte, 1300-sessionHeaderLen-gcmTagLen-frameHeaderLen)); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.reads) != 0 || len(sa.cover.queue) != 1 {
+		t.Fatalf("expected the probe to wait for a slot, %d sent and %d queued", len(b.reads), len(sa.cover.queue))
+	}
+
+	// Discovery still works when every probe waits for a slot
+	a, b = newMemConnPair(1452, 1400)
+	opts := []SessionOption{
+		WithCoverTraffic(CoverTraffic{FrameSize: 300, Bandwidth: 300 * 1000}),
+		WithProbeTimeout(20 * time.Millisecond),
+		WithMaxProbes(2),
+	}
+	sa, sb := newSessionPair(t, a, b, opts...)
+	defer sa.Close()
+	defer sb.Close()
+
+	go serve(t, a, sa, nil)
+	go serve(t, b, sb, nil)
+	defer a.Close()
+	defer b.Close()
+
+	pmtu, err := sa.DiscoverPMTU(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmtu != 1400 {
+		t.Errorf("expected pmtu 1400, got %d", pmtu)
+	}
+}
+
+func TestCoverTrafficConfig(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	key := bytes.Repeat([]byte{7}, 32)
+
+	if _, err := NewSession(a, b.addr, [16]byte{}, key, WithCoverTraffic(CoverTraffic{FrameSize: minCoverFrameSize - 1, Bandwidth: 1000})); err == nil {
+		t.Error("expected a frame size below the session overhead to fail")
+	}
+
+	// Following the path mtu keeps the bandwidth as frames grow
+	c := &coverTraffic{CoverTraffic: CoverTraffic{Bandwidth: 1200 * 10}}
+	if small, large := c.interval(BasePLPMTU), c.interval(2*BasePLPMTU); small != 100*time.Millisecond || large != 2*small {
+		t.Errorf("expected intervals of 100ms and 200ms, got %s and %s", small, large)
+	}
+}
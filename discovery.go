@@ -0,0 +1,273 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Well known rendezvous groups, with the group id "mp2p" in ascii
+var (
+	DiscoveryGroupLinkLocal = net.ParseIP("ff12::6d70:3270")
+	DiscoveryGroupSiteLocal = net.ParseIP("ff15::6d70:3270")
+	DiscoveryGroupIPv4      = net.IPv4(239, 255, 109, 112).To4()
+)
+
+// DiscoveryPort is the port rendezvous groups are joined on
+const DiscoveryPort = 1026
+
+// maxAnnouncementSkew is how far the time of an announcement may be from now, which limits
+// how long a captured announcement can be replayed
+const maxAnnouncementSkew = 5 * time.Minute
+
+// Rendezvous is a set of groups nodes announce themselves on to be discovered
+type Rendezvous struct {
+	Groups []net.IP
+	Port   int
+
+	// Options configure the connections to the groups, which always reuse the port and
+	// loop back so nodes on the same host find each other
+	Options []ConnOption
+}
+
+// DefaultRendezvous is the link local ipv6 and site local ipv4 rendezvous groups
+var DefaultRendezvous = Rendezvous{
+	Groups: []net.IP{DiscoveryGroupLinkLocal, DiscoveryGroupIPv4},
+	Port:   DiscoveryPort,
+}
+
+// DiscoveredPeer is a peer found through its verified announcement
+type DiscoveredPeer struct {
+	PeerURI
+
+	// Tags name the services of the peer
+	Tags []string
+
+	// Src is where the announcement was sent from
+	Src net.Addr
+
+	// Time is when the peer made the announcement
+	Time time.Time
+}
+
+// PeerFilter reports whether a discovered peer is wanted
+type PeerFilter func(p DiscoveredPeer) bool
+
+// HasTag accepts peers announcing the service tag
+func HasTag(tag string) PeerFilter {
+	return func(p DiscoveredPeer) bool {
+		for _, t := range p.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Announce announces the node's address and service tags on the default rendezvous groups
+// every interval, until the context is done
+func Announce(ctx context.Context, key ed25519.PrivateKey, addr net.UDPAddr, tags []string, interval time.Duration) error {
+	return DefaultRendezvous.Announce(ctx, key, addr, tags, interval)
+}
+
+// Discover reports the peers announcing themselves on the default rendezvous groups which
+// pass the filter, until the context is done
+func Discover(ctx context.Context, filter PeerFilter) (<-chan DiscoveredPeer, error) {
+	return DefaultRendezvous.Discover(ctx, filter)
+}
+
+// Announce announces the node's address and service tags on the rendezvous groups every
+// interval, until the context is done
+func (r Rendezvous) Announce(ctx context.Context, key ed25519.PrivateKey, addr net.UDPAddr, tags []string, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("announce interval must be positive")
+	}
+	if _, err := NewAnnouncementPayload(addr, tags, key); err != nil {
+		return err
+	}
+
+	conns, err := r.listen()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		announce(ctx, conns, key, addr, tags, interval)
+		closeAll(conns)
+	}()
+	return nil
+}
+
+// Discover reports the peers announcing themselves on the rendezvous groups which pass the
+// filter, until the context is done. Peers are reported when first seen, and again when
+// their address or tags change.
+func (r Rendezvous) Discover(ctx context.Context, filter PeerFilter) (<-chan DiscoveredPeer, error) {
+	conns, err := r.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		closeAll(conns)
+	}()
+	return discover(ctx, conns, filter), nil
+}
+
+// listen joins the rendezvous groups, leaving out groups that fail to join
+func (r Rendezvous) listen() ([]PacketConn, error) {
+	opts := append([]ConnOption{WithReusePort(true), WithLoopback(true)}, r.Options...)
+
+	var conns []PacketConn
+	var errs []string
+	for _, group := range r.Groups {
+		conn, err := NewMultiConn(group, r.Port, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", group, err))
+			continue
+		}
+		conns = append(conns, conn)
+	}
+
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("failed to join a rendezvous group: %s", strings.Join(errs, ", "))
+	}
+	return conns, nil
+}
+
+// announce signs a fresh announcement every interval and sends it to each group, on every
+// interface joined
+func announce(ctx context.Context, conns []PacketConn, key ed25519.PrivateKey, addr net.UDPAddr, tags []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if p, err := NewAnnouncementPayload(addr, tags, key); err == nil {
+			data := p.Bytes()
+			for _, conn := range conns {
+				writeAll(conn, data)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discover reads announcements from every connection until they are closed
+func discover(ctx context.Context, conns []PacketConn, filter PeerFilter) <-chan DiscoveredPeer {
+	out := make(chan DiscoveredPeer, 16)
+	seen := &peerTracker{peers: make(map[string]DiscoveredPeer)}
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn PacketConn) {
+			defer wg.Done()
+
+			buf := make([]byte, conn.MTU())
+			for {
+				n, src, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				p, err := ParseAnnouncementPayload(buf[:n])
+				if err != nil {
+					continue
+				}
+
+				peer, ok := seen.accept(p, src, time.Now())
+				if !ok || (filter != nil && !filter(peer)) {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- peer:
+				}
+			}
+		}(conn)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// maxTrackedPeers bounds the peers a discovery remembers, anyone can announce with new keys
+const maxTrackedPeers = 1024
+
+// peerTracker remembers the latest announcement of each peer, forgetting the peer announced
+// longest ago when full
+type peerTracker struct {
+	mu    sync.Mutex
+	peers map[string]DiscoveredPeer
+}
+
+// accept verifies an announcement, returning the peer if it is new or has changed
+func (t *peerTracker) accept(p AnnouncementPayload, src net.Addr, now time.Time) (DiscoveredPeer, bool) {
+	announced := time.Unix(int64(p.Time), 0)
+	if announced.Before(now.Add(-maxAnnouncementSkew)) || announced.After(now.Add(maxAnnouncementSkew)) {
+		return DiscoveredPeer{}, false
+	}
+	if !p.Validate() {
+		return DiscoveredPeer{}, false
+	}
+
+	peer := DiscoveredPeer{
+		PeerURI: PeerURI{
+			Key:  ed25519.PublicKey(append([]byte(nil), p.Src[:]...)),
+			Addr: &net.UDPAddr{IP: append(net.IP(nil), p.Address[:]...), Port: int(p.Port)},
+		},
+		Tags: p.Tags,
+		Src:  src,
+		Time: announced,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.peers[string(p.Src[:])]
+	if ok && !announced.After(last.Time) {
+		return DiscoveredPeer{}, false
+	}
+	if !ok && len(t.peers) >= maxTrackedPeers {
+		t.evictOldest()
+	}
+	t.peers[string(p.Src[:])] = peer
+
+	changed := !ok || !bytes.Equal(last.Addr.IP, peer.Addr.IP) || last.Addr.Port != peer.Addr.Port ||
+		strings.Join(last.Tags, "\x00") != strings.Join(peer.Tags, "\x00")
+	return peer, changed
+}
+
+func (t *peerTracker) evictOldest() {
+	var oldest string
+	var oldestTime time.Time
+	for k, p := range t.peers {
+		if oldestTime.IsZero() || p.Time.Before(oldestTime) {
+			oldest, oldestTime = k, p.Time
+		}
+	}
+	delete(t.peers, oldest)
+}
+
+func closeAll(conns []PacketConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
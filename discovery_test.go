@@ -0,0 +1,175 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestAnnouncementPayload(t *testing.T) {
+	key := testKey(1)
+	addr := net.UDPAddr{IP: NewIPv6(), Port: 1024}
+
+	p, err := NewAnnouncementPayload(addr, []string{"chat", "files"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseMessage(p.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) || !got.Validate() {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+
+	data := p.Bytes()
+	data[len(data)-1] ^= 1
+	if bad, _ := ParseAnnouncementPayload(data); bad.Validate() {
+		t.Error("expected tampered announcement to be invalid")
+	}
+
+	for _, data := range [][]byte{p.Bytes()[:AnnouncementMinLen], append(p.Bytes(), 0)} {
+		if _, err := ParseAnnouncementPayload(data); err == nil {
+			t.Errorf("expected %d bytes to fail", len(data))
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	key, other := testKey(1), testKey(2)
+	addr := net.UDPAddr{IP: NewIPv6(), Port: 1024}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	peers := discover(ctx, []PacketConn{b}, HasTag("chat"))
+
+	// Filtered, replayed and stale announcements are dropped
+	filtered, _ := NewAnnouncementPayload(net.UDPAddr{IP: NewIPv6(), Port: 1024}, []string{"files"}, other)
+	a.WriteTo(filtered.Bytes(), b.addr)
+
+	stale, _ := NewAnnouncementPayload(addr, []string{"chat"}, key)
+	stale.Time -= uint64(2 * maxAnnouncementSkew / time.Second)
+	a.WriteTo(stale.Bytes(), b.addr)
+
+	go announce(ctx, []PacketConn{a}, key, addr, []string{"chat"}, time.Millisecond)
+
+	peer := <-peers
+	if !bytes.Equal(peer.Key, key.Public().(ed25519.PublicKey)) || !peer.Addr.IP.Equal(addr.IP) || peer.Addr.Port != addr.Port {
+		t.Errorf("expected %s at %s, got %s", key.Public(), &addr, peer)
+	}
+
+	// Repeated announcements of an unchanged peer are only reported once
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case peer := <-peers:
+		t.Errorf("expected no more peers, got %s", peer)
+	default:
+	}
+}
+
+// linkConn is a MultiConn on several links, recording the link each write is sent on
+type linkConn struct {
+	rejoinConn
+
+	mu    sync.Mutex
+	links []int
+}
+
+func (c *linkConn) WriteBatch(ms []BatchMessage, flags int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range ms {
+		var cm ipv6.ControlMessage
+		if err := cm.Parse(m.OOB); err != nil {
+			return 0, err
+		}
+		c.links = append(c.links, cm.IfIndex)
+	}
+	return len(ms), nil
+}
+
+func (c *linkConn) sent() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.links...)
+}
+
+func TestAnnounceLinks(t *testing.T) {
+	eth0 := &net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	wlan0 := &net.Interface{Index: 3, Name: "wlan0", Flags: net.FlagUp | net.FlagMulticast}
+	c := &linkConn{rejoinConn: rejoinConn{memConn: memConn{addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024}}, ifis: []*net.Interface{eth0, wlan0}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		announce(ctx, []PacketConn{c}, testKey(1), net.UDPAddr{IP: NewIPv6(), Port: 1024}, nil, time.Hour)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.sent()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if links := c.sent(); !reflect.DeepEqual(links, []int{2, 3}) {
+		t.Errorf("expected an announcement on each link, got links %v", links)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	multicastIfi(t)
+
+	r := Rendezvous{Groups: []net.IP{DiscoveryGroupLinkLocal, DiscoveryGroupIPv4}, Port: 20004}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	peers, err := r.Discover(ctx, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	key := testKey(1)
+	if err := r.Announce(ctx, key, net.UDPAddr{IP: NewIPv6(), Port: 1024}, nil, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, ok := <-peers
+	if !ok {
+		t.Fatal("expected to discover the announcing peer")
+	}
+	if !bytes.Equal(peer.Key, key.Public().(ed25519.PublicKey)) {
+		t.Errorf("expected %x, got %x", []byte(key.Public().(ed25519.PublicKey)), []byte(peer.Key))
+	}
+}
+
+func TestPeerTrackerBound(t *testing.T) {
+	seen := &peerTracker{peers: make(map[string]DiscoveredPeer)}
+	addr := net.UDPAddr{IP: NewIPv6(), Port: 1024}
+
+	for i := 0; i <= maxTrackedPeers; i++ {
+		_, key, _ := ed25519.GenerateKey(nil)
+		p, err := NewAnnouncementPayload(addr, nil, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := seen.accept(p, nil, time.Now()); !ok {
+			t.Fatalf("expected peer %d to be new", i)
+		}
+	}
+
+	if len(seen.peers) != maxTrackedPeers {
+		t.Errorf("expected %d tracked peers, got %d", maxTrackedPeers, len(seen.peers))
+	}
+}
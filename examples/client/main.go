@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"flag"
@@ -16,34 +17,121 @@ import (
 )
 
 func main() {
-	addrFlag := flag.String("addr", "", "peer address to ping")
+	peerFlag := flag.String("peer", "", "peer uri, instead of -addr, -publ and -port")
+	discover := flag.Bool("discover", false, "find an announcing example server on the local network")
+	addrFlag := flag.String("addr", "", "peer address to ping (default derived from the peer key)")
+	ipv4 := flag.Bool("ipv4", false, "derive an ipv4 peer address")
 	publFlag := flag.String("publ", "", "peer public key")
 	portFlag := flag.Int("port", 1024, "peer port")
-	ifiFlag := flag.String("ifi", "en0", "network interface to use")
+	ifiFlag := flag.String("ifi", "", "network interfaces to choose from (glob)")
+	cidrFlag := flag.String("cidr", "", "only use interfaces with an address in the cidr")
 	debug := flag.Bool("v", false, "debug logging")
 	verbose := flag.Bool("vv", false, "verbose logging")
 	loop := flag.Bool("loop", false, "continue pinging server")
 	prefix := flag.Bool("prefix6", false, "use an ipv6 unicast prefixed multicast address")
+	hops := flag.Int("hops", mp2p.ScopeHopLimit, "multicast ttl and hop limit, -1 matches the address scope")
+	padFlag := flag.String("pad", "", "session padding policy (buckets, mtu, random)")
+	coverFlag := flag.Int("cover", 0, "constant rate cover traffic budget in bytes per second")
+	deflate := flag.Bool("deflate", false, "compress session data (leaks secrets mixed with untrusted data)")
+	knownFlag := flag.String("known", "", "known peers file (default ~/.mp2p/known_peers)")
+	warnChanged := flag.Bool("warn-changed", false, "only warn when a known peer's key changed")
 	flag.Parse()
 
+	padding, err := config.Padding(*padFlag)
+	if err != nil {
+		log.Fatalf("invalid padding: %v", err)
+	}
+
+	var opts []mp2p.SessionOption
+	if padding != nil {
+		opts = append(opts, mp2p.WithPadding(padding))
+	}
+	if *coverFlag > 0 {
+		opts = append(opts, mp2p.WithCoverTraffic(mp2p.CoverTraffic{Bandwidth: *coverFlag}))
+	}
+	if *deflate {
+		opts = append(opts, mp2p.WithCompression(mp2p.CompressionDeflate, nil))
+	}
+
 	// Parse the command line args for the peer to talk to
-	peerIP := net.ParseIP(*addrFlag)
-	if peerIP == nil {
-		log.Fatalf("failed to parse peer ip: %s", *addrFlag)
+	var peer mp2p.PeerURI
+	keyed := false
+	if *discover {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		peers, err := mp2p.Discover(ctx, mp2p.HasTag("example"))
+		if err != nil {
+			log.Fatalf("failed to discover peers: %v", err)
+		}
+		found, ok := <-peers
+		cancel()
+		if !ok {
+			log.Fatalf("no peers found")
+		}
+		log.Printf("discovered peer: %s", found.PeerURI)
+		peer = found.PeerURI
+	} else if *peerFlag != "" {
+		if peer, err = mp2p.ParsePeerURI(*peerFlag); err != nil {
+			log.Fatalf("failed to parse peer uri: %v", err)
+		}
+	} else {
+		peerKeyBytes, err := hex.DecodeString(*publFlag)
+		if len(peerKeyBytes) != ed25519.PublicKeySize || err != nil {
+			log.Fatalf("failed to parse peer key: %s", *publFlag)
+		}
+		peer.Key = ed25519.PublicKey(peerKeyBytes)
+
+		// Peers using keyed addresses can be found from their key alone
+		var peerIP net.IP
+		keyed = *addrFlag == ""
+		if keyed {
+			peerIP = config.KeyedGroup(peer.Key, 0, *ipv4)
+		} else {
+			group, err := mp2p.ParseGroup(*addrFlag)
+			if err != nil {
+				log.Fatalf("failed to parse peer ip: %v", err)
+			}
+			peerIP = group.IP
+		}
+		peer.Addr = &net.UDPAddr{IP: peerIP, Port: *portFlag}
 	}
 
-	peerAddr := &net.UDPAddr{IP: peerIP, Port: *portFlag}
+	// Trust the peer's key on first use, and check it hasn't changed since. Keyed addresses
+	// are derived from the key, another key has another address, so there is nothing to
+	// trust on first use.
+	var known *mp2p.KnownPeers
+	if !keyed {
+		if *knownFlag == "" {
+			if *knownFlag, err = mp2p.DefaultKnownPeersFile(); err != nil {
+				log.Fatalf("failed to find known peers: %v", err)
+			}
+		}
+		policy := mp2p.KeyChangeRefuse
+		if *warnChanged {
+			policy = mp2p.KeyChangeWarn
+		}
+		if known, err = mp2p.OpenKnownPeers(*knownFlag, mp2p.WithKeyChange(policy)); err != nil {
+			log.Fatalf("failed to open known peers: %v", err)
+		}
 
-	peerKeyBytes, err := hex.DecodeString(*publFlag)
-	if len(peerKeyBytes) != ed25519.PublicKeySize || err != nil {
-		log.Fatalf("failed to parse peer key: %s", *publFlag)
+		// Refuse a changed key up front, the key is only recorded once the peer proves it
+		// holds it by signing the session initiation response
+		if _, err := known.Check(mp2p.KnownPeerName(peer.Addr), peer.Key); err != nil {
+			log.Fatalf("refusing peer: %v (mp2p known remove %s to trust the new key)", err, mp2p.KnownPeerName(peer.Addr))
+		}
 	}
 
-	peerKey := ed25519.PublicKey(peerKeyBytes)
+	peerKey, peerKeyBytes := peer.Key, []byte(peer.Key)
+	peerAddr, peerIP := peer.Addr, peer.Addr.IP
 
 	// Client configuration
 	ip, key, err := config.GetConfig("client.conf", peerIP.To4() != nil)
 
+	connOpts, err := config.InterfaceFilters(*ifiFlag, *cidrFlag)
+	if err != nil {
+		log.Fatalf("invalid interface filter: %v", err)
+	}
+	connOpts = append(connOpts, mp2p.WithTTL(*hops), mp2p.WithHopLimit(*hops))
+
 	var ifi *net.Interface
 	if *prefix {
 		ip, ifi, err = mp2p.NewPrefixedIPv6()
@@ -51,21 +139,10 @@ func main() {
 			log.Fatalf("failed to generate ipv6 addr: %v", err)
 		}
 		log.Printf("using interface: %s", ifi.Name)
-	} else {
-		ifi, err = net.InterfaceByName(*ifiFlag)
-		if err != nil {
-			log.Println("interfaces include:")
-			allIfaces, _ := net.Interfaces()
-			for _, ifi := range allIfaces {
-				log.Println(" - " + ifi.Name)
-			}
-
-			log.Fatalf("network interface invalid: %v", err)
-		}
 	}
 
 	addr := net.UDPAddr{IP: ip, Port: 1025}
-	conn, err := mp2p.NewConn(ifi, addr.IP, addr.Port)
+	conn, err := mp2p.NewConn(ifi, addr.IP, addr.Port, connOpts...)
 	if err != nil {
 		log.Fatalf("failed to intialize client: %v", err)
 	}
@@ -81,27 +158,54 @@ func main() {
 		log.Fatalf("failed to generate session initiation with: %v", err)
 	}
 
+	// Keyed peers move to the keyed address of a later epoch when their group is taken, so
+	// look for them on each
+	targets := []*net.UDPAddr{peerAddr}
+	if keyed {
+		for epoch := uint64(1); epoch < config.KeyedEpochs; epoch++ {
+			targets = append(targets, &net.UDPAddr{IP: config.KeyedGroup(peer.Key, epoch, *ipv4), Port: peerAddr.Port})
+		}
+	}
+
 	// Write to the peer with a built in retry
 	msg, _, err := writeWithRetry(conn, 20, time.Second, func() {
-		if _, err := conn.WriteTo(addrDecl.Bytes(), peerAddr); err != nil {
-			log.Fatalf("failed to send address declaration with: %v", err)
-		}
+		for _, target := range targets {
+			if _, err := conn.WriteTo(addrDecl.Bytes(), target); err != nil {
+				log.Fatalf("failed to send address declaration with: %v", err)
+			}
 
-		if *debug {
-			log.Printf("sending session initiation payload")
-		} else if *verbose {
-			log.Printf("sending session initiation payload %+v", sessInit)
-		}
+			if *debug {
+				log.Printf("sending session initiation payload")
+			} else if *verbose {
+				log.Printf("sending session initiation payload %+v", sessInit)
+			}
 
-		// Send the session initiation
-		if _, err := conn.WriteTo(sessInit.Bytes(), peerAddr); err != nil {
-			log.Fatalf("failed to send session initiation with: %v", err)
+			// Send the session initiation
+			if _, err := conn.WriteTo(sessInit.Bytes(), target); err != nil {
+				log.Fatalf("failed to send session initiation with: %v", err)
+			}
 		}
 	})
 	if err != nil {
 		log.Fatalf("failed with: %v", err)
 	}
 
+	// Keyed peers declare the group they are on before responding
+	for keyed {
+		decl, ok := msg.(mp2p.AddressDeclarationPayload)
+		if !ok {
+			break
+		}
+		if bytes.Equal(decl.Src[:], peer.Key) && decl.Validate() {
+			peerAddr = &net.UDPAddr{IP: net.IP(decl.Address[:]), Port: int(decl.Port)}
+			log.Printf("peer is on addr: %s", peerAddr.IP)
+		}
+
+		if msg, _, err = read(conn); err != nil {
+			log.Fatalf("failed with: %v", err)
+		}
+	}
+
 	if *debug {
 		log.Printf("received response payload")
 	} else if *verbose {
@@ -122,10 +226,25 @@ func main() {
 			log.Fatalf("session initiation response for other node")
 		}
 
-		// Check the message signature
+		// Check the message signature, and that it answers this session
 		if !x.Validate() {
 			log.Fatalf("session initiation response had invalid signature")
 		}
+		if x.SessionID != sessInit.SessionID {
+			log.Fatalf("session initiation response for other session")
+		}
+
+		// The peer has proven it holds the key, record it
+		if known != nil {
+			switch status, err := known.VerifyPeer(peer); {
+			case err != nil:
+				log.Fatalf("refusing peer: %v (mp2p known remove %s to trust the new key)", err, mp2p.KnownPeerName(peer.Addr))
+			case status == mp2p.TrustNew:
+				log.Printf("trusting new peer %s", mp2p.KnownPeerName(peer.Addr))
+			case status == mp2p.TrustChanged:
+				log.Printf("WARNING: key of %s changed, trusting the new key", mp2p.KnownPeerName(peer.Addr))
+			}
+		}
 
 		sessKey, err = curve25519.X25519(sessSecret[:], x.SessionKey[:])
 		if err != nil {
@@ -135,19 +254,23 @@ func main() {
 		log.Fatalf("failed to receive response from server")
 	}
 
+	sess, err := mp2p.NewSession(conn, peerAddr, sessInit.SessionID, sessKey, opts...)
+	if err != nil {
+		log.Fatalf("failed to create session with: %v", err)
+	}
+	defer sess.Close()
+
 	// Send the server a message
-	sessData := mp2p.NewSessionDataPayload(sessKey, sessInit.SessionID, []byte("Hello server, how are you?"))
+	greeting := []byte("Hello server, how are you?")
 
 	send := func() {
 		msg, _, err = writeWithRetry(conn, 20, time.Second, func() {
-			if *debug {
+			if *debug || *verbose {
 				log.Printf("sending session data")
-			} else if *verbose {
-				log.Printf("sending session data %+v", sessData)
 			}
 
 			// Send the session data
-			if _, err := conn.WriteTo(sessData.Bytes(), peerAddr); err != nil {
+			if _, err := sess.Write(greeting); err != nil {
 				log.Fatalf("failed to send session data with: %v", err)
 			}
 		})
@@ -158,21 +281,27 @@ func main() {
 			log.Printf("received response payload %+v", msg)
 		}
 
-		switch x := msg.(type) {
-		case mp2p.SessionDataPayload:
-			// Check the session id
-			if !bytes.Equal(sessInit.SessionID[:], x.SessionID[:]) {
-				log.Fatalf("session data had wrong id %s", x.SessionID)
+		for {
+			x, ok := msg.(mp2p.SessionDataPayload)
+			if !ok {
+				log.Fatalf("failed to receive response from server")
 			}
 
-			response, err := x.Decrypt(sessKey)
+			// Check the session id and decrypt
+			response, err := sess.Handle(x)
 			if err != nil {
 				log.Fatalf("failed to decrypt session data with: %v", err)
 			}
 
-			fmt.Println(string(response))
-		default:
-			log.Fatalf("failed to receive response from server")
+			// Control frames such as compression offers carry no data, keep waiting for the reply
+			if response != nil {
+				fmt.Println(string(response))
+				return
+			}
+
+			if msg, _, err = read(conn); err != nil {
+				log.Fatalf("failed to receive response from server with: %v", err)
+			}
 		}
 	}
 	if *loop {
@@ -184,7 +313,7 @@ func main() {
 	}
 }
 
-func writeWithRetry(conn mp2p.PacketConn, count int, delay time.Duration, fn func()) (interface{}, []byte, error) {
+func writeWithRetry(conn mp2p.PacketConn, count int, delay time.Duration, fn func()) (mp2p.Message, []byte, error) {
 
 	done := make(chan bool)
 	defer close(done)
@@ -205,8 +334,8 @@ func writeWithRetry(conn mp2p.PacketConn, count int, delay time.Duration, fn fun
 	return read(conn)
 }
 
-func read(conn mp2p.PacketConn) (interface{}, []byte, error) {
-	data := make([]byte, 1500)
+func read(conn mp2p.PacketConn) (mp2p.Message, []byte, error) {
+	data := make([]byte, conn.MTU())
 	n, _, err := conn.ReadFrom(data)
 	if err != nil {
 		return nil, nil, err
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -21,6 +22,15 @@ func GetConfig(filename string, ipv4 bool) (net.IP, ed25519.PrivateKey, error) {
 		}
 
 		data := readFiledata(bin)
+
+		// Older versions generated ipv4 addresses outside the allowed range
+		if !mp2p.ClassifyGroup(data.IPv4[:]).Valid {
+			copy(data.IPv4[:], mp2p.NewIPv4())
+			if err := ioutil.WriteFile(filename, data.bytes(), os.ModePerm); err != nil {
+				return nil, nil, err
+			}
+		}
+
 		return data.ip(ipv4), data.Priv[:], nil
 
 	} else if os.IsNotExist(err) {
@@ -32,6 +42,53 @@ func GetConfig(filename string, ipv4 bool) (net.IP, ed25519.PrivateKey, error) {
 	return nil, nil, errors.New("file lookup failed")
 }
 
+// Padding returns the session padding policy with the given name, or nil for no padding
+func Padding(name string) (mp2p.PaddingPolicy, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "buckets":
+		return mp2p.PadToBuckets(128, 256, 512, 1024), nil
+	case "mtu":
+		return mp2p.PadToMTU(), nil
+	case "random":
+		return mp2p.PadRandom(255), nil
+	}
+
+	return nil, fmt.Errorf("unknown padding policy %q", name)
+}
+
+// InterfaceFilters returns the connection options selecting interfaces by name glob and by
+// having an address in the cidr, either of which may be empty
+func InterfaceFilters(name, cidr string) ([]mp2p.ConnOption, error) {
+	var filters []mp2p.InterfaceFilter
+	if name != "" {
+		filters = append(filters, mp2p.MatchName(name))
+	}
+
+	if cidr != "" {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, mp2p.MatchCIDR(network))
+	}
+
+	return []mp2p.ConnOption{mp2p.WithInterfaceFilter(filters...)}, nil
+}
+
+// KeyedEpochs is how many keyed addresses a server moves through when its group is taken,
+// clients look for it on each of them
+const KeyedEpochs = 8
+
+// KeyedGroup returns the keyed address of the key in an epoch
+func KeyedGroup(pub ed25519.PublicKey, epoch uint64, ipv4 bool) net.IP {
+	if ipv4 {
+		return mp2p.NewKeyedIPv4(pub, epoch%KeyedEpochs)
+	}
+	return mp2p.NewKeyedIPv6(pub, epoch%KeyedEpochs)
+}
+
 type filedata struct {
 	IPv4 [4]byte
 	IPv6 [16]byte
@@ -54,9 +111,13 @@ func newFiledata() (f filedata, data []byte) {
 	copy(f.IPv6[:], ipv6)
 	copy(f.Priv[:], priv)
 
+	return f, f.bytes()
+}
+
+func (f filedata) bytes() []byte {
 	var w bytes.Buffer
 	binary.Write(&w, binary.BigEndian, &f)
-	return f, w.Bytes()
+	return w.Bytes()
 }
 
 func readFiledata(data []byte) (f filedata) {
@@ -2,37 +2,104 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/jreamy/mp2p"
 	"github.com/jreamy/mp2p/examples/config"
 	"golang.org/x/crypto/curve25519"
 )
 
-type session struct {
-	id   string
-	key  []byte
-	addr net.Addr
-}
-
 func main() {
 
 	ipv4 := flag.Bool("ipv4", false, "use ipv4 address")
 	portFlag := flag.Int("port", 1024, "server port")
-	ifiFlag := flag.String("ifi", "en0", "network interface to use")
+	ifiFlag := flag.String("ifi", "", "network interfaces to choose from (glob)")
+	cidrFlag := flag.String("cidr", "", "only use interfaces with an address in the cidr")
+	multi := flag.Bool("multi", false, "join on every matching interface")
 	debug := flag.Bool("v", false, "debug logging")
 	verbose := flag.Bool("vv", false, "verbose logging")
 	prefix := flag.Bool("prefix6", false, "use an ipv6 unicast prefixed multicast address")
+	keyed := flag.Bool("keyed", false, "use the address derived from the public key")
+	announce := flag.Bool("announce", false, "announce the server for local discovery")
+	mdns := flag.Bool("mdns", false, "advertise the server with mdns / dns-sd")
+	hops := flag.Int("hops", mp2p.ScopeHopLimit, "multicast ttl and hop limit, -1 matches the address scope")
+	padFlag := flag.String("pad", "", "session padding policy (buckets, mtu, random)")
+	coverFlag := flag.Int("cover", 0, "constant rate cover traffic budget in bytes per second")
+	deflate := flag.Bool("deflate", false, "compress session data (leaks secrets mixed with untrusted data)")
+	knownFlag := flag.String("known", "", "known peers file, refusing declarations changing the key of a known address")
+	ssm := flag.Bool("ssm", false, "use a source specific address, only receiving from allowed sources")
+	sourcesFlag := flag.String("sources", "", "comma separated unicast addresses allowed to reach a source specific address")
 	flag.Parse()
 
+	// Prefixed addresses aren't source specific, so the two can't be combined
+	if *ssm && *prefix {
+		fmt.Fprintln(os.Stderr, "-ssm and -prefix6 can't be used together")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	padding, err := config.Padding(*padFlag)
+	if err != nil {
+		log.Fatalf("invalid padding: %v", err)
+	}
+
+	var opts []mp2p.SessionOption
+	if padding != nil {
+		opts = append(opts, mp2p.WithPadding(padding))
+	}
+	if *coverFlag > 0 {
+		opts = append(opts, mp2p.WithCoverTraffic(mp2p.CoverTraffic{Bandwidth: *coverFlag}))
+	}
+	if *deflate {
+		opts = append(opts, mp2p.WithCompression(mp2p.CompressionDeflate, nil))
+	}
+
 	ip, key, err := config.GetConfig("server.conf", *ipv4)
+	if *keyed {
+		ip = config.KeyedGroup(key.Public().(ed25519.PublicKey), 0, *ipv4)
+	}
+	if *ssm && *ipv4 {
+		ip = mp2p.NewSSMIPv4()
+	} else if *ssm {
+		ip = mp2p.NewSSMIPv6()
+	}
 	fmt.Println("using: " + ip.String())
 
+	connOpts, err := config.InterfaceFilters(*ifiFlag, *cidrFlag)
+	if err != nil {
+		log.Fatalf("invalid interface filter: %v", err)
+	}
+	connOpts = append(connOpts, mp2p.WithTTL(*hops), mp2p.WithHopLimit(*hops))
+
+	// A source specific group receives nothing without sources, so the first peers must be
+	// allowed up front, more are allowed as they start sessions
+	if *ssm {
+		var sources []net.IP
+		for _, s := range strings.Split(*sourcesFlag, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			src := net.ParseIP(s)
+			if src == nil {
+				log.Fatalf("invalid source: %s", s)
+			}
+			sources = append(sources, src)
+		}
+		if len(sources) == 0 {
+			log.Fatalf("a source specific address needs at least one of -sources")
+		}
+		connOpts = append(connOpts, mp2p.WithSourceSpecific(sources...))
+	}
+
 	var ifi *net.Interface
 	if *prefix {
 		ip, ifi, err = mp2p.NewPrefixedIPv6()
@@ -40,149 +107,435 @@ func main() {
 			log.Fatalf("failed to generate ipv6 addr: %v", err)
 		}
 		log.Printf("using interface: %s", ifi.Name)
-	} else {
-		ifi, err = net.InterfaceByName(*ifiFlag)
-		if err != nil {
-			log.Println("interfaces include:")
-			allIfaces, _ := net.Interfaces()
-			for _, ifi := range allIfaces {
-				log.Println(" - " + ifi.Name)
-			}
+	}
 
-			log.Fatalf("network interface invalid: %v", err)
+	// Groups moved to later are opened the same way
+	open := func(group net.IP, port int, opts ...mp2p.ConnOption) (mp2p.PacketConn, error) {
+		if *multi && ifi == nil {
+			return mp2p.NewMultiConn(group, port, opts...)
 		}
+		return mp2p.NewConn(ifi, group, port, opts...)
 	}
 
-	conn, err := mp2p.NewConn(ifi, ip, *portFlag)
+	conn, err := open(ip, *portFlag, connOpts...)
 	if err != nil {
 		log.Fatalf("failed to intiialize server: %v", err)
 	}
-	defer conn.Close()
+
+	// Probe the group membership and stay in the group across interface changes
+	filter := allowOwnAddrs(conn, ip)
+	renumbered := make(chan net.IP, 1)
+	conn, stop := watch(conn, renumbered)
+	defer func() { stop() }()
 
 	fmt.Printf("my addr: %s\nmy publ: %s\n", ip, hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+	fmt.Printf("my peer: %s\n", mp2p.PeerURI{Key: key.Public().(ed25519.PublicKey), Addr: &net.UDPAddr{IP: ip, Port: *portFlag}})
+
+	// Let clients on the local network and standard tools such as avahi-browse find the server
+	stopAdvertising := advertise(key, net.UDPAddr{IP: ip, Port: *portFlag}, *announce, *mdns)
+	defer func() { stopAdvertising() }()
+
+	// Notice other nodes that picked the same group, and move to a free one
+	detector := mp2p.NewCollisionDetector(key.Public().(ed25519.PublicKey), ip)
+	epoch := uint64(0)
+	allocator := &mp2p.Allocator{
+		Key:     key.Public().(ed25519.PublicKey),
+		Port:    *portFlag,
+		Options: connOpts,
+		Open:    open,
+		Generate: func() net.IP {
+			switch {
+			case *ssm && *ipv4:
+				return mp2p.NewSSMIPv4()
+			case *ssm:
+				return mp2p.NewSSMIPv6()
+			case *prefix:
+				ip, _, _ := mp2p.NewPrefixedIPv6()
+				return ip
+			case *keyed:
+				// Clients look for keyed servers in the next few epochs
+				epoch++
+				return config.KeyedGroup(key.Public().(ed25519.PublicKey), epoch, *ipv4)
+			case *ipv4:
+				return mp2p.NewIPv4()
+			}
+			return mp2p.NewIPv6()
+		},
+	}
+
+	// Peers are remembered across restarts, so clients needn't declare again
+	peers, err := mp2p.OpenAddressBook("server_peers.json", mp2p.WithEviction(mp2p.EvictStale(7*24*time.Hour), mp2p.EvictLeastRecent(4096)))
+	if err != nil {
+		log.Fatalf("failed to open address book: %v", err)
+	}
+	defer peers.Close()
 
-	// map of public key -> address
-	peers := make(map[string]net.Addr)
+	// Without a known peers file every peer is trusted
+	var known *mp2p.KnownPeers
+	if *knownFlag != "" {
+		if known, err = mp2p.OpenKnownPeers(*knownFlag, mp2p.WithHashedNames(true), mp2p.WithMaxPeers(4096)); err != nil {
+			log.Fatalf("failed to open known peers: %v", err)
+		}
+	}
 
 	// map of session id -> session key
-	sessions := make(map[string]session)
+	sessions := make(map[string]*mp2p.Session)
 
-	for {
-		data := make([]byte, 1500)
-		n, _, err := conn.ReadFrom(data)
-		if err != nil {
-			log.Printf("failed to read %s with %v", data, err)
-			continue
-		}
+	// set when another node is using the group
+	relocate := false
 
-		msg, err := mp2p.ParseMessage(data[:n])
-		if err != nil {
-			log.Printf("failed to parse message with %v", err)
-			continue
-		}
+	// Read up to a batch of datagrams per system call
+	batch := make([]mp2p.BatchMessage, 8)
+	for i := range batch {
+		batch[i].Buffers = [][]byte{make([]byte, conn.MTU())}
+	}
 
-		if *debug {
-			log.Printf("received payload")
-		} else if *verbose {
-			log.Printf("received payload %+v", msg)
+	for {
+		// Renumbering takes the group's unicast prefix away, so move to the group in the new one
+		var target net.IP
+		select {
+		case target = <-renumbered:
+		default:
 		}
 
-		switch x := msg.(type) {
-		case mp2p.AddressDeclarationPayload:
+		if relocate || target != nil {
+			relocate = false
+			conn.SetDeadline(time.Time{})
 
-			// Check the message signature
-			if !x.Validate() {
-				log.Printf("address declaration had invalid signature")
-				continue
-			}
+			// The old group's sessions end with it, peers start new ones on the new group
+			moved := func(next mp2p.PacketConn) error {
+				ip = detector.Group()
+				log.Printf("moved to addr: %s", ip)
 
-			if *debug || *verbose {
-				log.Printf("registering peer %+v", net.UDPAddr{Port: int(x.Port), IP: net.IP(x.Address[:])})
+				stopAdvertising()
+				stopAdvertising = advertise(key, net.UDPAddr{IP: ip, Port: *portFlag}, *announce, *mdns)
+				return declare(next, key, net.UDPAddr{IP: ip, Port: *portFlag}, peers)
 			}
 
-			// General application would be more selective that accepting any peer connection
-			// Add the remote address to the list of known addressess
-			peers[string(x.Src[:])] = &net.UDPAddr{Port: int(x.Port), IP: net.IP(x.Address[:])}
-
-		case mp2p.SessionInitiationPayload:
-			// Check the source is a known peer
-			peer, ok := peers[string(x.Src[:])]
-			if !ok {
-				log.Printf("session initiation by unknown peer")
+			var next mp2p.PacketConn
+			if target != nil {
+				next, err = allocator.Move(detector, target, moved)
+			} else {
+				next, err = allocator.Relocate(detector, moved)
+			}
+			if next == nil {
+				log.Printf("failed to relocate: %v", err)
 				continue
+			} else if err != nil {
+				log.Print(err)
 			}
 
-			// Check the destination is this node
-			if !bytes.Equal(key.Public().(ed25519.PublicKey), x.Dst[:]) {
-				log.Printf("session initiation for other node")
-				continue
+			stop()
+			filter = allowOwnAddrs(next, ip)
+			conn, stop = watch(next, renumbered)
+			sessions = make(map[string]*mp2p.Session)
+			for i := range batch {
+				batch[i].Buffers = [][]byte{make([]byte, conn.MTU())}
 			}
+		}
+
+		count, err := conn.ReadBatch(batch, 0)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Woken up to move to a new group
+			continue
+		} else if err != nil {
+			log.Printf("failed to read with %v", err)
+			continue
+		}
 
-			// Check the message signature
-			if !x.Validate() {
-				log.Printf("session initiation had invalid signature")
+		for _, m := range batch[:count] {
+			if relocate {
+				break
+			}
+			data := m.Buffers[0][:m.N]
+
+			// Session data is most of the traffic, so it is decrypted in place in the read buffer
+			if len(data) > 0 && data[0] == mp2p.TypeSessionData {
+				x, err := mp2p.ParseSessionDataPayloadInPlace(data)
+				if err != nil {
+					log.Printf("failed to parse session data with %v", err)
+					continue
+				}
+
+				// Check the session is known
+				sess, ok := sessions[string(x.SessionID[:])]
+				if !ok {
+					log.Printf("unknown session id")
+					continue
+				}
+
+				// Our example server is just going to print incoming requests and then respond
+				// with the given message
+
+				data, err := sess.HandleDatagram(data)
+				if err != nil {
+					log.Printf("failed to decipher with: " + err.Error())
+					continue
+				}
+
+				// Session control frames (like path mtu probes) carry no data
+				if data == nil {
+					continue
+				}
+
+				fmt.Println(string(data))
+
+				if *debug || *verbose {
+					log.Printf("sending session response")
+				}
+				sess.Write([]byte("Hi this is Jack : )"))
 				continue
 			}
 
-			// Any session initiation payload coming to the server will not be a response,
-			// peer to peer nodes would implement both initial payload and response logic
-
-			// Generate a session payload & key
-			resp, priv, err := mp2p.NewSessionInitiationPayload(key, x.Src[:], x.SessionID[:])
+			msg, err := mp2p.ParseMessage(data)
 			if err != nil {
-				log.Printf("failed to generate session initiation response")
+				log.Printf("failed to parse message with %v", err)
 				continue
 			}
 
-			// Compute & store the diffie hellman session key
-			sessID := string(x.SessionID[:])
-			sessKey, err := curve25519.X25519(priv[:], x.SessionKey[:])
-
-			sessions[sessID] = session{
-				id:   sessID,
-				key:  sessKey,
-				addr: peer,
+			if err := detector.Observe(msg); err != nil {
+				log.Printf("%v, moving to a new address", err)
+				relocate = true
+				continue
 			}
 
 			if *debug {
-				log.Printf("sending session initiation response")
+				log.Printf("received payload")
 			} else if *verbose {
-				log.Printf("sending session initiation response %+v", resp)
+				log.Printf("received payload %+v", msg)
 			}
 
-			// Respond to the client with their half of the diffie key
-			if _, err := conn.WriteTo(resp.Bytes(), peer); err != nil {
-				log.Printf("failed to send session initiation response")
-				continue
-			}
+			switch x := msg.(type) {
+			case mp2p.AddressDeclarationPayload:
+
+				if *debug || *verbose {
+					log.Printf("registering peer %+v", net.UDPAddr{Port: int(x.Port), IP: net.IP(x.Address[:])})
+				}
+
+				// Check the declared address keeps the key it was first declared with, it is only
+				// recorded once the peer starts a session
+				if known != nil && x.Validate() {
+					addr := &net.UDPAddr{Port: int(x.Port), IP: net.IP(x.Address[:])}
+					if _, err := known.Check(mp2p.KnownPeerName(addr), x.Src[:]); err != nil {
+						log.Printf("refusing peer: %v", err)
+						continue
+					}
+				}
+
+				// General application would be more selective that accepting any peer connection
+				// Check the message signature and add the remote address to the known addresses
+				if err := mp2p.ObserveDeclaration(peers, x, time.Now()); err != nil {
+					log.Printf("failed to register peer: %v", err)
+					continue
+				}
+
+			case mp2p.SessionInitiationPayload:
+				// Check the source is a known peer
+				record, ok := peers.Lookup(x.Src[:])
+				if !ok {
+					log.Printf("session initiation by unknown peer")
+					continue
+				}
+				peer := record.Addr()
+
+				// Check the destination is this node
+				if !bytes.Equal(key.Public().(ed25519.PublicKey), x.Dst[:]) {
+					log.Printf("session initiation for other node")
+					continue
+				}
+
+				// Check the message signature
+				if !x.Validate() {
+					log.Printf("session initiation had invalid signature")
+					continue
+				}
+
+				// Record the key of the peer's address, now that it has signed a session initiation
+				if known != nil {
+					if _, err := known.Verify(mp2p.KnownPeerName(peer), x.Src[:]); err != nil {
+						log.Printf("refusing peer: %v", err)
+						continue
+					}
+				}
+
+				// Keep receiving from the peer's unicast address for the rest of the session
+				if src, ok := m.Addr.(*net.UDPAddr); ok && filter != nil {
+					if err := filter.AddSource(src.IP); err != nil {
+						log.Printf("failed to allow source %s: %v", src.IP, err)
+					}
+				}
+
+				// Any session initiation payload coming to the server will not be a response,
+				// peer to peer nodes would implement both initial payload and response logic
+
+				// Generate a session payload & key
+				resp, priv, err := mp2p.NewSessionInitiationPayload(key, x.Src[:], x.SessionID[:])
+				if err != nil {
+					log.Printf("failed to generate session initiation response")
+					continue
+				}
+
+				// Compute & store the diffie hellman session key
+				sessID := string(x.SessionID[:])
+				sessKey, err := curve25519.X25519(priv[:], x.SessionKey[:])
+				if err != nil {
+					log.Printf("failed to compute session key with: %v", err)
+					continue
+				}
+
+				sess, err := mp2p.NewSession(conn, peer, x.SessionID, sessKey, opts...)
+				if err != nil {
+					log.Printf("failed to create session with: %v", err)
+					continue
+				}
+				sessions[sessID] = sess
+
+				if *debug {
+					log.Printf("sending session initiation response")
+				} else if *verbose {
+					log.Printf("sending session initiation response %+v", resp)
+				}
+
+				// Keyed clients look for the server on several groups, tell them which it is on
+				if *keyed {
+					decl := mp2p.NewAddressDeclarationPayload(net.UDPAddr{IP: ip, Port: *portFlag}, key)
+					if _, err := conn.WriteTo(decl.Bytes(), peer); err != nil {
+						log.Printf("failed to send address declaration")
+						continue
+					}
+				}
+
+				// Respond to the client with their half of the diffie key
+				if _, err := conn.WriteTo(resp.Bytes(), peer); err != nil {
+					log.Printf("failed to send session initiation response")
+					continue
+				}
 
-		case mp2p.SessionDataPayload:
-			// Check the session is known
-			sessID := string(x.SessionID[:])
-			sess, ok := sessions[sessID]
-			if !ok {
-				log.Printf("unknown session id")
-				continue
 			}
+		}
+	}
+}
 
-			// Our example server is just going to print incoming requests and then respond
-			// with the given message
+// allowOwnAddrs allows the server's own addresses on a source specific connection, its
+// membership probes come from them, returning the connection's source filter
+func allowOwnAddrs(conn mp2p.PacketConn, group net.IP) mp2p.SourceFilter {
+	filter, _ := conn.(mp2p.SourceFilter)
+	mc, ok := conn.(mp2p.MultiConn)
+	if !ok || filter == nil {
+		return filter
+	}
 
-			data, err := x.Decrypt(sess.key)
-			if err != nil {
-				log.Printf("failed to decipher with: " + err.Error())
-				continue
+	for _, ifi := range mc.Interfaces() {
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && (n.IP.To4() != nil) == (group.To4() != nil) {
+				if err := filter.AddSource(n.IP); err != nil {
+					log.Printf("failed to allow own address %s: %v", n.IP, err)
+				}
 			}
+		}
+	}
+	return filter
+}
 
-			fmt.Println(string(data))
+// watch probes the connection's group membership, rejoining when the probes stop arriving,
+// and keeps it in its group across interface flaps. When renumbering takes the unicast prefix
+// of its group away, the group in the new prefix is sent on renumbered and the reader is
+// woken up to move to it. Stop ends watching and closes the connection.
+func watch(conn mp2p.PacketConn, renumbered chan net.IP) (mp2p.PacketConn, func()) {
+	mc, ok := conn.(mp2p.MultiConn)
+	if !ok {
+		return conn, func() { conn.Close() }
+	}
 
-			resp := mp2p.NewSessionDataPayload(sess.key, x.SessionID, []byte("Hi this is Jack : )"))
-			if *debug {
-				log.Printf("sending session response")
-			} else if *verbose {
-				log.Printf("sending session response %+v", resp)
+	monitor, err := mp2p.NewMembershipMonitor(mc)
+	if err != nil {
+		log.Fatalf("failed to monitor group membership: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		health := mp2p.HealthUnknown
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-monitor.Updates():
+				if s.Health != health {
+					log.Printf("group membership %s (rejoins: %d, err: %v)", s.Health, s.Rejoins, s.Err)
+					health = s.Health
+				}
+			}
+		}
+	}()
+
+	w, err := mp2p.NewNetWatcher(0)
+	if err == nil {
+		go func() {
+			for ev := range mp2p.WatchMembership(ctx, mc, w.Subscribe()) {
+				log.Printf("%s on %s", ev.Kind, ev.Interface.Name)
+				if len(ev.Joined) > 0 {
+					log.Printf("joined group on %d new interfaces", len(ev.Joined))
+				}
+				if ev.Err != nil {
+					log.Printf("failed to rejoin group: %v", ev.Err)
+				}
+				if ev.Group != nil {
+					log.Printf("unicast prefix changed, moving to addr: %s", ev.Group)
+
+					// Only the latest group matters
+					select {
+					case <-renumbered:
+					default:
+					}
+					renumbered <- ev.Group
+					monitor.SetDeadline(time.Now())
+				}
 			}
-			conn.WriteTo(resp.Bytes(), sess.addr)
+		}()
+	}
+
+	return monitor, func() {
+		cancel()
+		if w != nil {
+			w.Close()
+		}
+		monitor.Close()
+	}
+}
+
+// advertise announces the server for local discovery and advertises it with mdns / dns-sd
+// as enabled, until stop is called
+func advertise(key ed25519.PrivateKey, addr net.UDPAddr, announce, mdns bool) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if announce {
+		if err := mp2p.Announce(ctx, key, addr, []string{"example"}, 5*time.Second); err != nil {
+			log.Printf("failed to announce: %v", err)
+		}
+	}
+
+	if mdns {
+		svc := mp2p.DNSSDService{PeerURI: mp2p.PeerURI{Key: key.Public().(ed25519.PublicKey), Addr: &addr}}
+		if err := mp2p.AdvertiseMDNS(ctx, svc); err != nil {
+			log.Printf("failed to advertise: %v", err)
 		}
 	}
+	return cancel
+}
+
+// declare sends the server's address to every peer in the address book
+func declare(conn mp2p.PacketConn, key ed25519.PrivateKey, addr net.UDPAddr, peers mp2p.AddressBook) error {
+	decl := mp2p.NewAddressDeclarationPayload(addr, key).Bytes()
+
+	var failed int
+	for _, record := range peers.Peers() {
+		if _, err := conn.WriteTo(decl, record.Addr()); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to declare new addr to %d peers", failed)
+	}
+	return nil
 }
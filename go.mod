@@ -5,6 +5,5 @@ go 1.17
 require (
 	golang.org/x/crypto v0.0.0-20210915214749-c084706c2272
 	golang.org/x/net v0.0.0-20210908191846-a5e095526f91
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 )
-
-require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
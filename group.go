@@ -0,0 +1,139 @@
+package mp2p
+
+import (
+	"fmt"
+	"net"
+)
+
+// GroupFlags are properties of a multicast group address
+type GroupFlags uint8
+
+const (
+	// GroupTransient addresses are dynamically assigned rather than permanently by IANA
+	GroupTransient GroupFlags = 1 << iota
+
+	// GroupPrefixBased addresses embed a unicast prefix (RFC 3306)
+	GroupPrefixBased
+
+	// GroupEmbeddedRP addresses embed the address of their rendezvous point (RFC 3956)
+	GroupEmbeddedRP
+
+	// GroupSSM addresses are source specific (RFC 4607)
+	GroupSSM
+)
+
+// GroupInfo describes a multicast group address
+type GroupInfo struct {
+	IP net.IP
+
+	// Family is 4 for ipv4 and 6 for ipv6 multicast addresses, and 0 otherwise
+	Family int
+
+	Scope Scope
+	Flags GroupFlags
+
+	// Prefix is the embedded unicast prefix of prefix based addresses
+	Prefix *net.IPNet
+
+	// RP is the embedded rendezvous point of embedded rp addresses
+	RP net.IP
+
+	// Valid reports whether mp2p nodes may use the address as their group
+	Valid bool
+
+	// Reason explains why the address is not valid, it is empty for valid addresses
+	Reason string
+}
+
+// ClassifyGroup describes the address and checks it lies in a range mp2p nodes may use: ipv6
+// transient, prefix based, embedded rp and source specific addresses of link local scope or
+// wider, and ipv4 addresses in 224.0.224.0-224.0.249.255, 232.0.1.0-232.255.255.255 or
+// 239.0.0.0/8.
+func ClassifyGroup(ip net.IP) (g GroupInfo) {
+	g.IP = ip
+
+	if ip4 := ip.To4(); ip4 != nil {
+		g.Family, g.Scope = 4, ScopeOf(ip4)
+
+		switch {
+		case ip4[0] == 224 && ip4[1] == 0 && ip4[2] >= 224 && ip4[2] <= 249:
+			g.Flags = GroupTransient
+		case ip4[0] == 232 && ip4[1] == 0 && ip4[2] == 0:
+			g.Flags, g.Reason = GroupSSM, "reserved source specific address"
+		case ip4[0] == 232:
+			g.Flags = GroupSSM
+		case ip4[0] == 239:
+			g.Flags = GroupTransient
+		default:
+			g.Reason = "outside the ipv4 ranges used by mp2p"
+		}
+
+		g.Valid = g.Reason == ""
+		return g
+	}
+
+	if len(ip) != net.IPv6len || ip[0] != 0xff {
+		g.Reason = "not a multicast address"
+		return g
+	}
+
+	g.Family, g.Scope = 6, Scope(ip[1]&0x0f)
+	flags := ip[1] >> 4
+	if flags&0x1 != 0 {
+		g.Flags |= GroupTransient
+	}
+
+	switch {
+	case flags&0x1 == 0:
+		g.Reason = "permanently assigned address"
+	case !g.Scope.valid():
+		g.Reason = fmt.Sprintf("unusable %s", g.Scope)
+	case flags == 0x1:
+	case flags == 0x3 && isSSM(ip):
+		g.Flags |= GroupSSM
+		for _, b := range ip[4:12] {
+			if b != 0 {
+				g.Reason = "source specific address with a prefix"
+			}
+		}
+	case flags == 0x3:
+		g.Flags |= GroupPrefixBased
+		if g.Prefix = unicastPrefix(ip); g.Prefix == nil || ip[2] != 0 {
+			g.Reason = "invalid unicast prefix"
+		}
+	case flags == 0x7:
+		g.Flags |= GroupPrefixBased | GroupEmbeddedRP
+		if g.RP = EmbeddedRP(ip); g.RP == nil {
+			g.Reason = "invalid embedded rendezvous point"
+		} else {
+			g.Prefix = unicastPrefix(ip)
+		}
+	default:
+		g.Reason = fmt.Sprintf("unsupported flags %x", flags)
+	}
+
+	g.Valid = g.Reason == ""
+	return g
+}
+
+// ParseGroup parses and classifies a group address, failing if it isn't valid
+func ParseGroup(s string) (GroupInfo, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return GroupInfo{}, fmt.Errorf("invalid group %q: not an ip address", s)
+	}
+
+	g := ClassifyGroup(ip)
+	if !g.Valid {
+		return g, fmt.Errorf("invalid group %s: %s", ip, g.Reason)
+	}
+	return g, nil
+}
+
+// validGroup returns the address if it is a valid group, and nil otherwise
+func validGroup(ip net.IP) net.IP {
+	if ip == nil || !ClassifyGroup(ip).Valid {
+		return nil
+	}
+	return ip
+}
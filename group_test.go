@@ -0,0 +1,82 @@
+package mp2p
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassifyGroup(t *testing.T) {
+	tests := []struct {
+		ip     string
+		family int
+		scope  Scope
+		flags  GroupFlags
+		valid  bool
+	}{
+		{"ff1e::1", 6, ScopeGlobal, GroupTransient, true},
+		{"ff12::1", 6, ScopeLinkLocal, GroupTransient, true},
+		{"ff3e:40:2001:db8:1:2:8000:1", 6, ScopeGlobal, GroupTransient | GroupPrefixBased, true},
+		{"ff3e:80:2602:47:2243:bf02:8a39:de81", 6, ScopeGlobal, GroupTransient | GroupPrefixBased, true},
+		{"ff3e:41:2001:db8:1:2:8000:1", 6, ScopeGlobal, GroupTransient | GroupPrefixBased, false},
+		{"ff38::8000:1", 6, ScopeOrganizationLocal, GroupTransient | GroupSSM, true},
+		{"ff7e:340:2001:db8:beef:feed::1", 6, ScopeGlobal, GroupTransient | GroupPrefixBased | GroupEmbeddedRP, true},
+		{"ff02::1", 6, ScopeLinkLocal, 0, false},
+		{"ff11::1", 6, 1, GroupTransient, false},
+		{"ff3e:0:2001:db8::1", 6, ScopeGlobal, GroupTransient | GroupSSM, false},
+		{"ff7e:40:2001:db8::1", 6, ScopeGlobal, GroupTransient | GroupPrefixBased | GroupEmbeddedRP, false},
+		{"224.0.230.1", 4, ScopeGlobal, GroupTransient, true},
+		{"224.0.250.1", 4, ScopeGlobal, 0, false},
+		{"232.1.2.3", 4, ScopeGlobal, GroupSSM, true},
+		{"232.0.0.3", 4, ScopeGlobal, GroupSSM, false},
+		{"239.255.1.1", 4, ScopeSiteLocal, GroupTransient, true},
+		{"2001:db8::1", 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		g := ClassifyGroup(net.ParseIP(test.ip))
+		if g.Family != test.family || g.Scope != test.scope || g.Flags != test.flags || g.Valid != test.valid {
+			t.Errorf("%s: expected %d %s %b %v, got %+v", test.ip, test.family, test.scope, test.flags, test.valid, g)
+		}
+		if !g.Valid && g.Reason == "" {
+			t.Errorf("%s: expected a reason", test.ip)
+		}
+	}
+
+	g := ClassifyGroup(net.ParseIP("ff7e:340:2001:db8:beef:feed::1"))
+	if g.Prefix.String() != "2001:db8:beef:feed::/64" || !g.RP.Equal(net.ParseIP("2001:db8:beef:feed::3")) {
+		t.Errorf("expected embedded prefix and rp, got %s and %s", g.Prefix, g.RP)
+	}
+
+	// Earlier versions set the prefix length to the mask width
+	if g := ClassifyGroup(net.ParseIP("ff3e:80:2602:47:2243:bf02:8a39:de81")); g.Prefix.String() != "2602:47:2243:bf02::/64" {
+		t.Errorf("expected a 64 bit prefix for the legacy encoding, got %s", g.Prefix)
+	}
+
+	if _, err := ParseGroup("224.0.250.1"); err == nil {
+		t.Error("expected out of range group to fail")
+	}
+	if _, err := ParseGroup("ff1e::1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGeneratorsValid(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::10/64")
+	for i := 0; i < 100; i++ {
+		for _, ip := range []net.IP{NewIPv4(), NewIPv6(), NewIPv6FromPrefix(prefix), NewSSMIPv4(), NewSSMIPv6(), NewAdminScopedIPv4(ScopeSiteLocal)} {
+			if g := ClassifyGroup(ip); !g.Valid {
+				t.Fatalf("generated invalid group %s: %s", ip, g.Reason)
+			}
+		}
+	}
+}
+
+func TestDeclarationRejectsInvalidGroup(t *testing.T) {
+	key := testKey(1)
+	if decl := NewAddressDeclarationPayload(net.UDPAddr{IP: NewIPv4(), Port: 1024}, key); !decl.Validate() {
+		t.Error("expected valid declaration")
+	}
+	if decl := NewAddressDeclarationPayload(net.UDPAddr{IP: net.ParseIP("224.0.250.1"), Port: 1024}, key); decl.Validate() {
+		t.Error("expected declaration of an out of range group to be rejected")
+	}
+}
@@ -0,0 +1,306 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Health is the state of a connection's group membership
+type Health int
+
+const (
+	// HealthUnknown is reported until the first probe has been sent
+	HealthUnknown Health = iota
+
+	// Healthy connections received their last probe
+	Healthy
+
+	// Degraded connections missed recent probes, but not enough to rejoin
+	Degraded
+
+	// Unhealthy connections missed enough probes to have rejoined their groups, and have
+	// not received a probe since
+	Unhealthy
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Unhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+// HealthStatus describes how well a connection is receiving its own group
+type HealthStatus struct {
+	Health Health
+
+	// LastProbe is when a probe was last received, zero if none has been
+	LastProbe time.Time
+
+	// Missed is the number of probes missed in a row
+	Missed int
+
+	// Rejoins is the number of times the groups have been rejoined
+	Rejoins int
+
+	// Err is the error of the last failed probe or rejoin
+	Err error
+}
+
+// probeMACLen is the length of the truncated hmac-sha256 ending probes
+const probeMACLen = 16
+
+// MonitorOption configures optional MembershipMonitor behaviour
+type MonitorOption func(*MembershipMonitor)
+
+// WithRefreshInterval sets how often probes are sent, 5 seconds by default
+func WithRefreshInterval(d time.Duration) MonitorOption {
+	return func(m *MembershipMonitor) {
+		m.interval = d
+	}
+}
+
+// WithMissedProbes sets how many probes in a row must go missing before the groups are
+// rejoined, 3 by default
+func WithMissedProbes(n int) MonitorOption {
+	return func(m *MembershipMonitor) {
+		m.maxMissed = n
+	}
+}
+
+// MembershipMonitor checks a connection is still in its group by periodically sending a
+// probe to the group, and rejoins the groups when the probes stop arriving.
+//
+// Probes are only received while the monitor is being read from, its reads drop the
+// probes and pass anything else through. Probes carry a mac keyed by a random key of the
+// monitor, so other nodes on the group can't forge probes to hide a lost membership, though
+// they can see and replay them. Other receivers parse them as MembershipProbePayload.
+type MembershipMonitor struct {
+	MultiConn
+
+	interval  time.Duration
+	maxMissed int
+	token     [16]byte
+	macKey    []byte
+
+	mu       sync.Mutex
+	status   HealthStatus
+	sent     uint32
+	received uint32
+	updates  chan HealthStatus
+
+	done chan struct{}
+	once sync.Once
+}
+
+// loopbacker is implemented by connections that can receive their own multicast packets
+type loopbacker interface {
+	SetMulticastLoopback(on bool) error
+}
+
+// NewMembershipMonitor starts monitoring the connection's group membership, enabling
+// multicast loopback so the connection receives its own probes
+func NewMembershipMonitor(conn MultiConn, opts ...MonitorOption) (*MembershipMonitor, error) {
+	m := &MembershipMonitor{
+		MultiConn: conn,
+		interval:  5 * time.Second,
+		maxMissed: 3,
+		updates:   make(chan HealthStatus, 8),
+		done:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.interval <= 0 {
+		return nil, errors.New("refresh interval must be positive")
+	}
+	if m.maxMissed <= 0 {
+		return nil, errors.New("missed probes must be positive")
+	}
+
+	if _, err := rand.Read(m.token[:]); err != nil {
+		return nil, err
+	}
+	m.macKey = make([]byte, sha256.Size)
+	if _, err := rand.Read(m.macKey); err != nil {
+		return nil, err
+	}
+
+	if l, ok := conn.(loopbacker); ok {
+		if err := l.SetMulticastLoopback(true); err != nil {
+			return nil, err
+		}
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// Status returns the current health of the connection
+func (m *MembershipMonitor) Status() HealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Updates receives the status after every probe, updates are dropped while the channel
+// is full
+func (m *MembershipMonitor) Updates() <-chan HealthStatus {
+	return m.updates
+}
+
+// ReadFrom reads the next datagram that isn't one of the monitor's probes
+func (m *MembershipMonitor) ReadFrom(b []byte) (n int, src net.Addr, err error) {
+	for {
+		n, src, err = m.MultiConn.ReadFrom(b)
+		if err != nil || !m.consume(b[:n]) {
+			return n, src, err
+		}
+	}
+}
+
+// ReadMsg reads the next datagram that isn't one of the monitor's probes
+func (m *MembershipMonitor) ReadMsg(b []byte) (n int, info PacketInfo, err error) {
+	for {
+		n, info, err = m.MultiConn.ReadMsg(b)
+		if err != nil || !m.consume(b[:n]) {
+			return n, info, err
+		}
+	}
+}
+
+// ReadBatch reads a batch of datagrams, moving the monitor's probes past the returned count
+func (m *MembershipMonitor) ReadBatch(ms []BatchMessage, flags int) (int, error) {
+	for {
+		n, err := m.MultiConn.ReadBatch(ms, flags)
+
+		kept := 0
+		for i := 0; i < n; i++ {
+			if m.consume(ms[i].Buffers[0][:ms[i].N]) {
+				continue
+			}
+			ms[kept], ms[i] = ms[i], ms[kept]
+			kept++
+		}
+
+		if kept > 0 || n == 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// Close stops monitoring and closes the connection
+func (m *MembershipMonitor) Close() error {
+	m.once.Do(func() { close(m.done) })
+	return m.MultiConn.Close()
+}
+
+// consume records the datagram if it is one of the monitor's probes
+func (m *MembershipMonitor) consume(b []byte) bool {
+	if len(b) != MembershipProbeLen || b[0] != TypeMembershipProbe || !bytes.Equal(b[1:17], m.token[:]) {
+		return false
+	}
+
+	// Forged probes are still the monitor's, they are dropped without counting
+	if !hmac.Equal(b[21:], m.mac(b[:21])) {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if seq := binary.BigEndian.Uint32(b[17:]); seq > m.received {
+		m.received = seq
+		m.status.LastProbe = time.Now()
+	}
+	return true
+}
+
+// mac returns the truncated mac of a probe's type, token and sequence
+func (m *MembershipMonitor) mac(b []byte) []byte {
+	h := hmac.New(sha256.New, m.macKey)
+	h.Write(b)
+	return h.Sum(nil)[:probeMACLen]
+}
+
+func (m *MembershipMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	probe := make([]byte, MembershipProbeLen)
+	probe[0] = TypeMembershipProbe
+	copy(probe[1:], m.token[:])
+
+	for {
+		m.mu.Lock()
+		m.sent++
+		seq := m.sent
+		m.mu.Unlock()
+
+		binary.BigEndian.PutUint32(probe[17:], seq)
+		copy(probe[21:], m.mac(probe[:21]))
+		_, err := m.MultiConn.WriteTo(probe, m.Group())
+
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+
+		m.check(seq, err)
+	}
+}
+
+// check updates the status once a probe has had an interval to arrive
+func (m *MembershipMonitor) check(seq uint32, err error) {
+	m.mu.Lock()
+	status := &m.status
+	status.Err = err
+
+	if m.received >= seq {
+		status.Health, status.Missed = Healthy, 0
+	} else {
+		status.Missed++
+		if status.Health != Unhealthy {
+			status.Health = Degraded
+		}
+	}
+
+	rejoin := status.Missed >= m.maxMissed
+	m.mu.Unlock()
+
+	// Rejoin without holding the lock, reads consuming probes must not wait on it
+	if rejoin {
+		rerr := m.Rejoin()
+
+		m.mu.Lock()
+		status.Health, status.Missed = Unhealthy, 0
+		status.Rejoins++
+		if rerr != nil {
+			status.Err = rerr
+		}
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	s := m.status
+	m.mu.Unlock()
+
+	select {
+	case m.updates <- s:
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package mp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// newLoopConn returns a MultiConn receiving its own writes, unless they exceed the path mtu
+func newLoopConn(pathMTU int) *rejoinConn {
+	c := &rejoinConn{memConn: memConn{
+		addr:    &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+		mtu:     1452,
+		pathMTU: pathMTU,
+		reads:   make(chan pkt, 64),
+	}}
+	c.peer = &c.memConn
+	return c
+}
+
+// awaitHealth reads from the monitor until it reports the health
+func awaitHealth(t *testing.T, m *MembershipMonitor, health Health) HealthStatus {
+	go func() {
+		buf := make([]byte, m.MTU())
+		for {
+			if _, _, err := m.ReadFrom(buf); err != nil {
+				return
+			}
+			t.Error("expected probes to be consumed")
+		}
+	}()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case s := <-m.Updates():
+			if s.Health == health {
+				return s
+			}
+		case <-timeout:
+			t.Fatalf("expected %s, still %s", health, m.Status().Health)
+		}
+	}
+}
+
+func TestMembershipMonitor(t *testing.T) {
+	m, err := NewMembershipMonitor(newLoopConn(1452), WithRefreshInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	s := awaitHealth(t, m, Healthy)
+	if s.LastProbe.IsZero() || s.Rejoins != 0 {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
+
+func TestMembershipMonitorRejoin(t *testing.T) {
+	// Nothing fits the path, so no probe ever arrives
+	m, err := NewMembershipMonitor(newLoopConn(0), WithRefreshInterval(5*time.Millisecond), WithMissedProbes(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if s := awaitHealth(t, m, Unhealthy); s.Rejoins != 1 {
+		t.Errorf("expected a rejoin, got %+v", s)
+	}
+}
+
+func TestMembershipMonitorForgedProbe(t *testing.T) {
+	c := newLoopConn(1452)
+	m, err := NewMembershipMonitor(c, WithRefreshInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	probe := make([]byte, MembershipProbeLen)
+	probe[0] = TypeMembershipProbe
+	copy(probe[1:], m.token[:])
+	binary.BigEndian.PutUint32(probe[17:], 100)
+	if !m.consume(probe) {
+		t.Error("expected a forged probe to be dropped")
+	}
+
+	copy(probe[21:], m.mac(probe[:21]))
+	if !m.consume(probe) {
+		t.Error("expected a signed probe to be consumed")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.received != 100 {
+		t.Errorf("expected only the signed probe to count, received %d", m.received)
+	}
+
+	// Other receivers on the group recognise probes
+	msg, err := ParseMessage(probe)
+	if p, ok := msg.(MembershipProbePayload); err != nil || !ok || p.Seq != 100 || p.Token != m.token {
+		t.Errorf("expected a membership probe, got %+v %v", msg, err)
+	}
+	if b, _ := MarshalMessage(msg); !bytes.Equal(b, probe) {
+		t.Errorf("expected the probe to marshal back to %x, got %x", probe, b)
+	}
+}
+
+func TestMembershipMonitorReadBatch(t *testing.T) {
+	c := newLoopConn(1452)
+	m, err := NewMembershipMonitor(c, WithRefreshInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	c.WriteTo([]byte("hello"), c.addr)
+
+	batch := make([]BatchMessage, 4)
+	for i := range batch {
+		batch[i].Buffers = [][]byte{make([]byte, m.MTU())}
+	}
+
+	// The first probe is sent on start, it should never be returned
+	time.Sleep(10 * time.Millisecond)
+	n, err := m.ReadBatch(batch, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 message, got %d with %v", n, err)
+	}
+	if got := string(batch[0].Buffers[0][:batch[0].N]); got != "hello" {
+		t.Errorf("expected hello, got %q", got)
+	}
+}
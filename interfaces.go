@@ -0,0 +1,178 @@
+package mp2p
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+// InterfaceCandidate is a network interface considered for joining a multicast group
+type InterfaceCandidate struct {
+	Interface net.Interface
+	Addrs     []*net.IPNet
+
+	// Score ranks eligible candidates, higher is better
+	Score int
+
+	// Reason explains why the candidate is not eligible, it is empty for eligible candidates
+	Reason string
+}
+
+// Eligible reports whether the candidate can be used
+func (c InterfaceCandidate) Eligible() bool {
+	return c.Reason == ""
+}
+
+func (c InterfaceCandidate) String() string {
+	if c.Reason != "" {
+		return fmt.Sprintf("%s (%s)", c.Interface.Name, c.Reason)
+	}
+	return fmt.Sprintf("%s (score %d)", c.Interface.Name, c.Score)
+}
+
+// InterfaceFilter reports whether a candidate interface may be used
+type InterfaceFilter func(c InterfaceCandidate) bool
+
+// MatchName accepts interfaces whose name matches the glob pattern, as in path.Match
+func MatchName(pattern string) InterfaceFilter {
+	return func(c InterfaceCandidate) bool {
+		ok, _ := path.Match(pattern, c.Interface.Name)
+		return ok
+	}
+}
+
+// MatchCIDR accepts interfaces with an address in the network
+func MatchCIDR(network *net.IPNet) InterfaceFilter {
+	return func(c InterfaceCandidate) bool {
+		for _, addr := range c.Addrs {
+			if network.Contains(addr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NoInterfaceError is returned when no interface is eligible to join a group
+type NoInterfaceError struct {
+	Group      net.IP
+	Candidates []InterfaceCandidate
+}
+
+func (e *NoInterfaceError) Error() string {
+	names := make([]string, len(e.Candidates))
+	for i, c := range e.Candidates {
+		names[i] = c.String()
+	}
+	return fmt.Sprintf("no usable multicast interface for %s, candidates: %s", e.Group, strings.Join(names, ", "))
+}
+
+// virtualPrefixes are name prefixes of common virtual, tunnel and container interfaces
+var virtualPrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "utun", "tun", "tap", "wg", "zt",
+	"awdl", "llw", "anpi", "bridge", "gif", "stf",
+}
+
+// RankInterfaces lists every interface as a candidate for joining the group, eligible ones
+// first from best to worst. Interfaces must be up, multicast capable and pass the filters,
+// and are ranked by owning the group's unicast prefix, having a global unicast address of
+// the group's family, and not being loopback or virtual.
+func RankInterfaces(group net.IP, filters ...InterfaceFilter) ([]InterfaceCandidate, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := group.To4() != nil
+	prefix := unicastPrefix(group)
+
+	candidates := make([]InterfaceCandidate, 0, len(ifis))
+	for _, ifi := range ifis {
+		c := InterfaceCandidate{Interface: ifi}
+
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				c.Addrs = append(c.Addrs, n)
+			}
+		}
+
+		switch {
+		case ifi.Flags&net.FlagUp == 0:
+			c.Reason = "down"
+		case ifi.Flags&net.FlagMulticast == 0:
+			c.Reason = "no multicast"
+		case !passes(c, filters):
+			c.Reason = "filtered"
+		}
+
+		c.Score = score(c, ipv4, prefix)
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Eligible() != candidates[j].Eligible() {
+			return candidates[i].Eligible()
+		}
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates, nil
+}
+
+// SelectInterface returns the best ranked interface for joining the group
+func SelectInterface(group net.IP, filters ...InterfaceFilter) (*net.Interface, error) {
+	candidates, err := RankInterfaces(group, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(candidates) == 0 || !candidates[0].Eligible() {
+		return nil, &NoInterfaceError{Group: group, Candidates: candidates}
+	}
+	return &candidates[0].Interface, nil
+}
+
+// score ranks a candidate, each property counting once however many addresses have it
+func score(c InterfaceCandidate, ipv4 bool, prefix *net.IPNet) int {
+	var inPrefix, global bool
+	for _, n := range c.Addrs {
+		inPrefix = inPrefix || (prefix != nil && prefix.Contains(n.IP))
+		global = global || (n.IP.IsGlobalUnicast() && (n.IP.To4() != nil) == ipv4)
+	}
+
+	score := 0
+	if inPrefix {
+		score += 8
+	}
+	if global {
+		score += 4
+	}
+	if c.Interface.Flags&net.FlagLoopback == 0 {
+		score += 2
+	}
+	if !isVirtual(c.Interface) {
+		score++
+	}
+	return score
+}
+
+func passes(c InterfaceCandidate, filters []InterfaceFilter) bool {
+	for _, filter := range filters {
+		if !filter(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVirtual(ifi net.Interface) bool {
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(ifi.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
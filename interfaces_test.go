@@ -0,0 +1,92 @@
+package mp2p
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRankInterfaces(t *testing.T) {
+	candidates, err := RankInterfaces(net.ParseIP("224.0.250.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(candidates); i++ {
+		prev, c := candidates[i-1], candidates[i]
+		if c.Eligible() && !prev.Eligible() {
+			t.Errorf("eligible %s ranked after ineligible %s", c, prev)
+		}
+		if c.Eligible() == prev.Eligible() && c.Score > prev.Score {
+			t.Errorf("%s ranked after lower scoring %s", c, prev)
+		}
+	}
+}
+
+func TestScoreInterface(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, inPrefix, _ := net.ParseCIDR("2001:db8:1::10/64")
+	_, global, _ := net.ParseCIDR("2001:db8:2::10/64")
+	_, global2, _ := net.ParseCIDR("2001:db8:3::10/64")
+
+	// The prefix and global bonuses count once, whatever the order of the addresses
+	for _, addrs := range [][]*net.IPNet{
+		{global, inPrefix},
+		{inPrefix, global, global2},
+		{global2, global, inPrefix, inPrefix},
+	} {
+		c := InterfaceCandidate{Interface: net.Interface{Name: "eth0"}, Addrs: addrs}
+		if got := score(c, false, prefix); got != 8+4+2+1 {
+			t.Errorf("expected score 15 for %v, got %d", addrs, got)
+		}
+	}
+
+	c := InterfaceCandidate{Interface: net.Interface{Name: "docker0", Flags: net.FlagLoopback}, Addrs: []*net.IPNet{global}}
+	if got := score(c, true, prefix); got != 0 {
+		t.Errorf("expected score 0 for a loopback virtual ipv6 only interface, got %d", got)
+	}
+}
+
+func TestSelectInterfaceError(t *testing.T) {
+	_, err := SelectInterface(net.ParseIP("ff1e::1"), MatchName("no-such-interface*"))
+
+	var noIfi *NoInterfaceError
+	if !errors.As(err, &noIfi) {
+		t.Fatalf("expected NoInterfaceError, got %v", err)
+	}
+
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if !strings.Contains(err.Error(), ifi.Name) {
+			t.Errorf("expected %s listed in %q", ifi.Name, err)
+		}
+	}
+}
+
+func TestInterfaceFilters(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.10/24")
+	c := InterfaceCandidate{
+		Interface: net.Interface{Name: "eth0"},
+		Addrs:     []*net.IPNet{lan},
+	}
+
+	_, match, _ := net.ParseCIDR("192.168.0.0/16")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		filter InterfaceFilter
+		ok     bool
+	}{
+		{MatchName("eth*"), true},
+		{MatchName("en?"), false},
+		{MatchCIDR(match), true},
+		{MatchCIDR(other), false},
+	}
+
+	for i, test := range tests {
+		if ok := test.filter(c); ok != test.ok {
+			t.Errorf("filter %d: expected %v, got %v", i, test.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package mp2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// knownPeerKeyType names the key type of known peers entries, as in ssh known_hosts
+	knownPeerKeyType = "ed25519"
+
+	// knownPeerPinned marks entries whose key never changes, however the store handles changes
+	knownPeerPinned = "@pinned"
+
+	// hashedPrefix starts hashed names, |1|<salt>|<hmac-sha256 of the name>
+	hashedPrefix = "|1|"
+)
+
+// TrustStatus is the outcome of checking a peer's key
+type TrustStatus int
+
+const (
+	// TrustNew is a peer seen for the first time, whose key is now recorded
+	TrustNew TrustStatus = iota
+
+	// TrustKnown is a peer with the key recorded for it
+	TrustKnown
+
+	// TrustChanged is a peer with a different key than the one recorded for it
+	TrustChanged
+)
+
+func (s TrustStatus) String() string {
+	switch s {
+	case TrustNew:
+		return "new"
+	case TrustKnown:
+		return "known"
+	case TrustChanged:
+		return "changed"
+	}
+	return fmt.Sprintf("trust(%d)", int(s))
+}
+
+// KeyChangedError is returned when a peer's key differs from the recorded key
+type KeyChangedError struct {
+	Name  string
+	Known ed25519.PublicKey
+	Got   ed25519.PublicKey
+
+	// Pinned is set when the recorded key was pinned
+	Pinned bool
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("key of %s changed from %s to %s", e.Name, fingerprint(e.Known), fingerprint(e.Got))
+}
+
+// KeyChangePolicy is how key changes of peers that aren't pinned are handled
+type KeyChangePolicy int
+
+const (
+	// KeyChangeRefuse returns a KeyChangedError and keeps the recorded key
+	KeyChangeRefuse KeyChangePolicy = iota
+
+	// KeyChangeWarn accepts and records the new key, reporting TrustChanged so callers can
+	// warn about it
+	KeyChangeWarn
+)
+
+// KnownPeer is an entry of a known peers file
+type KnownPeer struct {
+	// Name is the peer's group and port, or the hashed name for hashed entries
+	Name string
+	Key  ed25519.PublicKey
+
+	// Pinned entries are never replaced by a changed key
+	Pinned bool
+}
+
+// Hashed reports whether the entry's name is hashed
+func (p KnownPeer) Hashed() bool {
+	return strings.HasPrefix(p.Name, hashedPrefix)
+}
+
+// matches reports whether the entry is for the name, hashing it with the entry's salt for
+// hashed entries
+func (p KnownPeer) matches(name string) bool {
+	if !p.Hashed() {
+		return p.Name == name
+	}
+
+	parts := strings.Split(p.Name[len(hashedPrefix):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(hashName(salt, name)), []byte(p.Name))
+}
+
+// String returns the entry as a line of a known peers file
+func (p KnownPeer) String() string {
+	line := p.Name + " " + knownPeerKeyType + " " + strings.ToLower(peerEncoding.EncodeToString(p.Key))
+	if p.Pinned {
+		line = knownPeerPinned + " " + line
+	}
+	return line
+}
+
+// KnownPeerName is the name peers are recorded under, their group and port
+func KnownPeerName(addr *net.UDPAddr) string {
+	return addr.String()
+}
+
+// DefaultKnownPeersFile is ~/.mp2p/known_peers
+func DefaultKnownPeersFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".mp2p", "known_peers"), nil
+}
+
+// KnownPeersOption configures a known peers store
+type KnownPeersOption func(*KnownPeers)
+
+// WithKeyChange sets how key changes of peers that aren't pinned are handled, refusing them
+// by default
+func WithKeyChange(policy KeyChangePolicy) KnownPeersOption {
+	return func(k *KnownPeers) {
+		k.policy = policy
+	}
+}
+
+// WithHashedNames hashes the names of new entries, so the file doesn't list the groups of
+// the peers it knows
+func WithHashedNames(hashed bool) KnownPeersOption {
+	return func(k *KnownPeers) {
+		k.hashed = hashed
+	}
+}
+
+// WithMaxPeers bounds the entries, forgetting the oldest entries that aren't pinned as new
+// peers are recorded
+func WithMaxPeers(n int) KnownPeersOption {
+	return func(k *KnownPeers) {
+		k.max = n
+	}
+}
+
+// KnownPeers is a trust on first use store of peer keys, saved to a file in the style of
+// ssh known_hosts. It is safe for concurrent use.
+type KnownPeers struct {
+	mu       sync.Mutex
+	filename string
+	peers    []KnownPeer
+	policy   KeyChangePolicy
+	hashed   bool
+	max      int
+}
+
+// OpenKnownPeers loads the known peers file, which is created on the first save if it
+// doesn't exist
+func OpenKnownPeers(filename string, opts ...KnownPeersOption) (*KnownPeers, error) {
+	k := &KnownPeers{filename: filename}
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if k.peers, err = parseKnownPeers(data); err != nil {
+		return nil, fmt.Errorf("invalid known peers %s: %w", filename, err)
+	}
+	return k, nil
+}
+
+func parseKnownPeers(data []byte) ([]KnownPeer, error) {
+	var peers []KnownPeer
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p KnownPeer
+		fields := strings.Fields(line)
+		if fields[0] == knownPeerPinned {
+			p.Pinned = true
+			fields = fields[1:]
+		}
+		if len(fields) != 3 || fields[1] != knownPeerKeyType {
+			return nil, fmt.Errorf("line %d: expected <name> %s <key>", n, knownPeerKeyType)
+		}
+
+		key, err := parsePeerKey(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		p.Name, p.Key = fields[0], key
+		peers = append(peers, p)
+	}
+	return peers, s.Err()
+}
+
+// VerifyPeer checks the key of the peer uri against the key recorded for its group
+func (k *KnownPeers) VerifyPeer(p PeerURI) (TrustStatus, error) {
+	return k.Verify(KnownPeerName(p.Addr), p.Key)
+}
+
+// Verify checks the key against the key recorded for the name. The key of a new peer is
+// recorded and trusted from then on. A changed key is refused with a KeyChangedError when
+// pinned or by the KeyChangeRefuse policy, and otherwise replaces the recorded key.
+//
+// Only verify keys the peer has proven it holds, such as by signing a session initiation,
+// anyone can claim a key.
+func (k *KnownPeers) Verify(name string, key ed25519.PublicKey) (TrustStatus, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return TrustNew, fmt.Errorf("invalid peer key length %d", len(key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	i := k.index(name)
+	status, err := k.check(i, name, key)
+	switch {
+	case err != nil || status == TrustKnown:
+		return status, err
+	case status == TrustNew:
+		k.trim()
+		k.peers = append(k.peers, k.entry(name, key, false))
+	default:
+		k.peers[i].Key = append(ed25519.PublicKey(nil), key...)
+	}
+	return status, k.save()
+}
+
+// Check compares the key with the key recorded for the name like Verify, without recording
+// anything
+func (k *KnownPeers) Check(name string, key ed25519.PublicKey) (TrustStatus, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return TrustNew, fmt.Errorf("invalid peer key length %d", len(key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.check(k.index(name), name, key)
+}
+
+func (k *KnownPeers) check(i int, name string, key ed25519.PublicKey) (TrustStatus, error) {
+	if i < 0 {
+		return TrustNew, nil
+	}
+
+	known := k.peers[i]
+	if bytes.Equal(known.Key, key) {
+		return TrustKnown, nil
+	}
+	if known.Pinned || k.policy == KeyChangeRefuse {
+		return TrustChanged, &KeyChangedError{Name: name, Known: known.Key, Got: key, Pinned: known.Pinned}
+	}
+	return TrustChanged, nil
+}
+
+// trim forgets the oldest entries that aren't pinned, leaving room for a new entry
+func (k *KnownPeers) trim() {
+	if k.max <= 0 {
+		return
+	}
+
+	for j := 0; len(k.peers) >= k.max && j < len(k.peers); {
+		if k.peers[j].Pinned {
+			j++
+			continue
+		}
+		k.peers = append(k.peers[:j], k.peers[j+1:]...)
+	}
+}
+
+// Pin records the key for the name, replacing any recorded key, and never accepts another
+func (k *KnownPeers) Pin(name string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid peer key length %d", len(key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if i := k.index(name); i >= 0 {
+		k.peers[i].Key = append(ed25519.PublicKey(nil), key...)
+		k.peers[i].Pinned = true
+	} else {
+		k.peers = append(k.peers, k.entry(name, key, true))
+	}
+	return k.save()
+}
+
+// Remove forgets the entries for the name, or with a hashed name, returning how many were
+// removed
+func (k *KnownPeers) Remove(name string) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	peers := k.peers[:0]
+	for _, p := range k.peers {
+		if !p.matches(name) && p.Name != name {
+			peers = append(peers, p)
+		}
+	}
+
+	n := len(k.peers) - len(peers)
+	k.peers = peers
+	if n == 0 {
+		return 0, nil
+	}
+	return n, k.save()
+}
+
+// Lookup returns the entry for the name
+func (k *KnownPeers) Lookup(name string) (KnownPeer, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if i := k.index(name); i >= 0 {
+		return k.peers[i], true
+	}
+	return KnownPeer{}, false
+}
+
+// Peers returns every entry in file order
+func (k *KnownPeers) Peers() []KnownPeer {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]KnownPeer(nil), k.peers...)
+}
+
+func (k *KnownPeers) index(name string) int {
+	for i, p := range k.peers {
+		if p.matches(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *KnownPeers) entry(name string, key ed25519.PublicKey, pinned bool) KnownPeer {
+	if k.hashed {
+		salt := make([]byte, sha256.Size)
+		rand.Read(salt)
+		name = hashName(salt, name)
+	}
+	return KnownPeer{Name: name, Key: append(ed25519.PublicKey(nil), key...), Pinned: pinned}
+}
+
+// save replaces the file with the entries
+func (k *KnownPeers) save() error {
+	var b bytes.Buffer
+	for _, p := range k.peers {
+		b.WriteString(p.String())
+		b.WriteByte('\n')
+	}
+
+	if dir := filepath.Dir(k.filename); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(k.filename), filepath.Base(k.filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.filename)
+}
+
+func hashName(salt []byte, name string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(name))
+	return hashedPrefix + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
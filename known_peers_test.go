@@ -0,0 +1,131 @@
+package mp2p
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKnownPeers(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "known_peers")
+	key, other := testKey(1).Public().(ed25519.PublicKey), testKey(2).Public().(ed25519.PublicKey)
+	p := PeerURI{Key: key, Addr: &net.UDPAddr{IP: net.ParseIP("ff1e::1234"), Port: 1024}}
+
+	k, err := OpenKnownPeers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking records nothing
+	if status, err := k.Check(KnownPeerName(p.Addr), key); status != TrustNew || err != nil {
+		t.Fatalf("expected a new peer, got %s %v", status, err)
+	}
+	if _, ok := k.Lookup(KnownPeerName(p.Addr)); ok {
+		t.Fatal("expected checking not to record the peer")
+	}
+
+	if status, err := k.VerifyPeer(p); status != TrustNew || err != nil {
+		t.Fatalf("expected a new peer, got %s %v", status, err)
+	}
+	if status, err := k.VerifyPeer(p); status != TrustKnown || err != nil {
+		t.Fatalf("expected a known peer, got %s %v", status, err)
+	}
+
+	// The recorded key survives reopening, and changes are refused by default
+	if k, err = OpenKnownPeers(filename); err != nil {
+		t.Fatal(err)
+	}
+	var changed *KeyChangedError
+	if status, err := k.Check(KnownPeerName(p.Addr), other); status != TrustChanged || !errors.As(err, &changed) {
+		t.Fatalf("expected a changed key error, got %s %v", status, err)
+	}
+	if status, err := k.Verify(KnownPeerName(p.Addr), other); status != TrustChanged || !errors.As(err, &changed) {
+		t.Fatalf("expected a changed key error, got %s %v", status, err)
+	}
+
+	// Warning accepts the new key unless it is pinned
+	k, _ = OpenKnownPeers(filename, WithKeyChange(KeyChangeWarn))
+	if status, err := k.Verify(KnownPeerName(p.Addr), other); status != TrustChanged || err != nil {
+		t.Fatalf("expected an accepted changed key, got %s %v", status, err)
+	}
+	if err := k.Pin(KnownPeerName(p.Addr), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Verify(KnownPeerName(p.Addr), other); !errors.As(err, &changed) || !changed.Pinned {
+		t.Fatalf("expected a pinned key to be refused, got %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(filename)
+	if want := "@pinned [ff1e::1234]:1024 ed25519 "; !strings.HasPrefix(string(data), want) {
+		t.Errorf("expected file to start with %q, got %q", want, data)
+	}
+
+	if n, err := k.Remove(KnownPeerName(p.Addr)); n != 1 || err != nil {
+		t.Errorf("expected 1 entry removed, got %d %v", n, err)
+	}
+	if _, ok := k.Lookup(KnownPeerName(p.Addr)); ok {
+		t.Error("expected the entry to be removed")
+	}
+}
+
+func TestKnownPeersMax(t *testing.T) {
+	k, _ := OpenKnownPeers(filepath.Join(t.TempDir(), "known_peers"), WithMaxPeers(2))
+	key := testKey(1).Public().(ed25519.PublicKey)
+
+	k.Pin("pinned", key)
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := k.Verify(name, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, p := range k.Peers() {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, " "); got != "pinned c" {
+		t.Errorf("expected the oldest unpinned entries forgotten, got %q", got)
+	}
+}
+
+func TestKnownPeersHashed(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "known_peers")
+	key := testKey(1).Public().(ed25519.PublicKey)
+	name := "[ff1e::1234]:1024"
+
+	k, _ := OpenKnownPeers(filename, WithHashedNames(true))
+	k.Verify(name, key)
+
+	data, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(data), "ff1e") || !strings.HasPrefix(string(data), hashedPrefix) {
+		t.Errorf("expected a hashed name, got %q", data)
+	}
+
+	// Hashed entries match their name, whether hashing is enabled or not
+	k, _ = OpenKnownPeers(filename)
+	if status, err := k.Verify(name, key); status != TrustKnown || err != nil {
+		t.Errorf("expected a known peer, got %s %v", status, err)
+	}
+	if _, ok := k.Lookup("[ff1e::1234]:1025"); ok {
+		t.Error("expected other names not to match")
+	}
+}
+
+func TestParseKnownPeers(t *testing.T) {
+	key := strings.ToLower(peerEncoding.EncodeToString(testKey(1).Public().(ed25519.PublicKey)))
+
+	peers, err := parseKnownPeers([]byte("# comment\n\n224.0.230.1:1024 ed25519 " + key + "\n@pinned [ff1e::1]:1024 ed25519 " + key + "\n"))
+	if err != nil || len(peers) != 2 || peers[0].Pinned || !peers[1].Pinned {
+		t.Errorf("unexpected peers %v %v", peers, err)
+	}
+
+	for _, line := range []string{"224.0.230.1:1024 rsa " + key, "224.0.230.1:1024 ed25519 abc", "224.0.230.1:1024"} {
+		if _, err := parseKnownPeers([]byte(line)); err == nil {
+			t.Errorf("expected %q to fail", line)
+		}
+	}
+}
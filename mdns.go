@@ -0,0 +1,764 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// MDNSServiceType is the dns service discovery type of mp2p endpoints
+	MDNSServiceType = "_mp2p._udp.local."
+
+	// mdnsServicesType lists the service types on the link (RFC 6763 section 9)
+	mdnsServicesType = "_services._dns-sd._udp.local."
+
+	// mdnsTTL is the ttl of advertised records in seconds
+	mdnsTTL = 120
+
+	// mdnsCacheFlush marks records the responder is the only owner of (RFC 6762 section 10.2)
+	mdnsCacheFlush = 0x8000
+
+	// mdnsProbes is how many probes are sent before claiming the names (RFC 6762 section 8.1)
+	mdnsProbes = 3
+
+	// mdnsProbeInterval is the time between probes
+	mdnsProbeInterval = 250 * time.Millisecond
+
+	// mdnsAnnounceInterval is the time between the announcements made after probing
+	mdnsAnnounceInterval = time.Second
+)
+
+// MDNSRendezvous is the multicast dns groups and port
+var MDNSRendezvous = Rendezvous{
+	Groups:  []net.IP{net.IPv4(224, 0, 0, 251).To4(), net.ParseIP("ff02::fb")},
+	Port:    5353,
+	Options: []ConnOption{WithTTL(255), WithHopLimit(255)},
+}
+
+// DNSSDService is an mp2p endpoint advertised with dns service discovery
+type DNSSDService struct {
+	// Instance names the endpoint, it is derived from the key when empty
+	Instance string
+
+	PeerURI
+}
+
+// AdvertiseMDNS answers multicast dns queries for the service until the context is done
+func AdvertiseMDNS(ctx context.Context, svc DNSSDService) error {
+	return MDNSRendezvous.AdvertiseMDNS(ctx, svc)
+}
+
+// BrowseMDNS reports the services advertised with multicast dns until the context is done
+func BrowseMDNS(ctx context.Context) (<-chan DNSSDService, error) {
+	return MDNSRendezvous.BrowseMDNS(ctx)
+}
+
+// AdvertiseMDNS answers dns service discovery queries on the rendezvous groups for the
+// service, announcing it once the names are probed to be free and saying goodbye when the
+// context is done. The service's host is named mp2p-<fingerprint>.local., and a name taken
+// by another responder is renamed with a number.
+func (r Rendezvous) AdvertiseMDNS(ctx context.Context, svc DNSSDService) error {
+	if svc.Addr == nil || len(svc.Key) != ed25519.PublicKeySize {
+		return errors.New("service needs a key and an address")
+	}
+
+	conns, err := r.listen()
+	if err != nil {
+		return err
+	}
+
+	// Addresses change with the network, and are announced again when they do
+	var events <-chan NetEvent
+	w, err := NewNetWatcher(0)
+	if err == nil {
+		events = w.Subscribe()
+	}
+
+	resp := newMDNSResponder(svc, hostAddrs(conns))
+	go func() {
+		resp.serve(ctx, conns, events)
+		if w != nil {
+			w.Close()
+		}
+		closeAll(conns)
+	}()
+	return nil
+}
+
+// BrowseMDNS queries the rendezvous groups for mp2p services, reporting each service when
+// first seen and again when it changes
+func (r Rendezvous) BrowseMDNS(ctx context.Context) (<-chan DNSSDService, error) {
+	conns, err := r.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		closeAll(conns)
+	}()
+	return browseMDNS(ctx, conns), nil
+}
+
+// mdnsResponder answers queries for a single service
+type mdnsResponder struct {
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	svc      DNSSDService
+
+	// addrs are the host's addresses on each interface, by index
+	addrs map[int][]net.IP
+
+	probeInterval    time.Duration
+	announceInterval time.Duration
+}
+
+func newMDNSResponder(svc DNSSDService, addrs map[int][]net.IP) *mdnsResponder {
+	if svc.Instance == "" {
+		svc.Instance = "mp2p " + fingerprint(svc.Key)
+	}
+
+	m := &mdnsResponder{svc: svc, addrs: addrs, probeInterval: mdnsProbeInterval, announceInterval: mdnsAnnounceInterval}
+	m.rename(true, true, 1)
+	return m
+}
+
+// rename names the instance and host, numbering names after the first
+func (m *mdnsResponder) rename(instance, host bool, n int) {
+	suffix := ""
+	if n > 1 {
+		suffix = " (" + strconv.Itoa(n) + ")"
+	}
+	if instance {
+		m.instance = dnsmessage.MustNewName(mdnsLabel(m.svc.Instance+suffix) + "." + MDNSServiceType)
+	}
+
+	if n > 1 {
+		suffix = "-" + strconv.Itoa(n)
+	}
+	if host {
+		m.host = dnsmessage.MustNewName(mdnsLabel("mp2p-"+fingerprint(m.svc.Key)+suffix) + ".local.")
+	}
+}
+
+// mdnsPacket is a message read by a responder
+type mdnsPacket struct {
+	conn    PacketConn
+	ifIndex int
+	data    []byte
+}
+
+// serve probes the names, announces the service, answers queries until the context is done,
+// then says goodbye. The host's addresses are looked up again on every network event, and
+// announced again when they changed.
+func (m *mdnsResponder) serve(ctx context.Context, conns []PacketConn, events <-chan NetEvent) {
+	packets := make(chan mdnsPacket, 16)
+	for _, conn := range conns {
+		go func(conn PacketConn) {
+			buf := make([]byte, conn.MTU())
+			for {
+				n, info, err := conn.ReadMsg(buf)
+				if err != nil {
+					return
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case packets <- mdnsPacket{conn: conn, ifIndex: info.IfIndex, data: append([]byte(nil), buf[:n]...)}:
+				}
+			}
+		}(conn)
+	}
+
+	if !m.probe(ctx, conns, packets) {
+		return
+	}
+
+	// Announcements are made twice, a second apart (RFC 6762 section 8.3)
+	m.sendAll(conns, func(ifIndex int) []byte { return m.response(m.all(mdnsTTL, ifIndex), nil) })
+	announce := time.NewTimer(m.announceInterval)
+	defer announce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.sendAll(conns, func(ifIndex int) []byte { return m.response(m.all(0, ifIndex), nil) })
+			return
+		case <-announce.C:
+			m.sendAll(conns, func(ifIndex int) []byte { return m.response(m.all(mdnsTTL, ifIndex), nil) })
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+
+			addrs := hostAddrs(conns)
+			if sameHostAddrs(addrs, m.addrs) {
+				continue
+			}
+			m.addrs = addrs
+
+			// Changed records are announced like new ones (RFC 6762 section 8.4)
+			m.sendAll(conns, func(ifIndex int) []byte { return m.response(m.all(mdnsTTL, ifIndex), nil) })
+			if !announce.Stop() {
+				select {
+				case <-announce.C:
+				default:
+				}
+			}
+			announce.Reset(m.announceInterval)
+		case p := <-packets:
+			if resp := m.answer(p.data, p.ifIndex); resp != nil {
+				writeOn(p.conn, p.ifIndex, resp)
+			}
+		}
+	}
+}
+
+// probe queries for the names with the records about to be claimed until no other responder
+// objects, renaming taken names, and returns false if the context is done first
+func (m *mdnsResponder) probe(ctx context.Context, conns []PacketConn, packets <-chan mdnsPacket) bool {
+	for n := 1; ; {
+		conflict := mdnsConflict{}
+		for i := 0; i < mdnsProbes && conflict == (mdnsConflict{}); i++ {
+			m.sendAll(conns, m.probeQuery)
+
+			wait := time.NewTimer(m.probeInterval)
+			for waiting := true; waiting && conflict == (mdnsConflict{}); {
+				select {
+				case <-ctx.Done():
+					wait.Stop()
+					return false
+				case <-wait.C:
+					waiting = false
+				case p := <-packets:
+					conflict = m.conflict(p.data)
+				}
+			}
+			wait.Stop()
+		}
+
+		switch {
+		case conflict == (mdnsConflict{}):
+			return true
+		case conflict.instance || conflict.host:
+			n++
+			m.rename(conflict.instance, conflict.host, n)
+		default:
+			// A simultaneous probe won the tie break, it should claim the names by the time
+			// the names are probed again (RFC 6762 section 8.2)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(4 * m.probeInterval):
+			}
+		}
+	}
+}
+
+// probeQuery asks for any records of the names, proposing the responder's records
+func (m *mdnsResponder) probeQuery(ifIndex int) []byte {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{Name: m.instance, Type: dnsmessage.TypeALL, Class: dnsmessage.ClassINET},
+			{Name: m.host, Type: dnsmessage.TypeALL, Class: dnsmessage.ClassINET},
+		},
+		Authorities: append([]dnsmessage.Resource{m.srv(mdnsTTL), m.txt(mdnsTTL)}, m.hostRecords(mdnsTTL, ifIndex)...),
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+// mdnsConflict is how another responder's message conflicts with the responder's names
+type mdnsConflict struct {
+	// instance and host are set when the names are taken
+	instance, host bool
+
+	// lost is set when a simultaneous probe for the names won the tie break
+	lost bool
+}
+
+// conflict checks a message for other responders' records of the names. Records matching the
+// responder's own, such as its own probes and announcements looping back, don't conflict.
+func (m *mdnsResponder) conflict(data []byte) (c mdnsConflict) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil {
+		return c
+	}
+
+	if msg.Header.Response {
+		for _, r := range append(msg.Answers, msg.Additionals...) {
+			if r.Header.TTL == 0 || m.owns(r) {
+				continue
+			}
+			switch {
+			case strings.EqualFold(r.Header.Name.String(), m.instance.String()):
+				c.instance = true
+			case strings.EqualFold(r.Header.Name.String(), m.host.String()):
+				c.host = true
+			}
+		}
+		return c
+	}
+
+	// Simultaneous probes are compared record by record, the lexicographically later set of
+	// records wins
+	for _, name := range []dnsmessage.Name{m.instance, m.host} {
+		var theirs []dnsmessage.Resource
+		own := true
+		for _, r := range msg.Authorities {
+			if strings.EqualFold(r.Header.Name.String(), name.String()) {
+				theirs = append(theirs, r)
+				own = own && m.owns(r)
+			}
+		}
+
+		// The responder's own probes propose its records for a single interface
+		if len(theirs) == 0 || own {
+			continue
+		}
+
+		var ours []dnsmessage.Resource
+		for _, r := range append([]dnsmessage.Resource{m.srv(mdnsTTL), m.txt(mdnsTTL)}, m.hostRecords(mdnsTTL, 0)...) {
+			if strings.EqualFold(r.Header.Name.String(), name.String()) {
+				ours = append(ours, r)
+			}
+		}
+		if compareRecords(ours, theirs) < 0 {
+			c.lost = true
+		}
+	}
+	return c
+}
+
+// owns reports whether the record is one of the responder's
+func (m *mdnsResponder) owns(r dnsmessage.Resource) bool {
+	for _, own := range append([]dnsmessage.Resource{m.srv(mdnsTTL), m.txt(mdnsTTL)}, m.hostRecords(mdnsTTL, 0)...) {
+		if r.Header.Type == own.Header.Type && strings.EqualFold(r.Header.Name.String(), own.Header.Name.String()) &&
+			bytes.Equal(rdata(r), rdata(own)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareRecords compares sorted record sets by class, type and data (RFC 6762 section 8.2)
+func compareRecords(a, b []dnsmessage.Resource) int {
+	sortRecords(a)
+	sortRecords(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareRecord(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func sortRecords(rs []dnsmessage.Resource) {
+	sort.Slice(rs, func(i, j int) bool { return compareRecord(rs[i], rs[j]) < 0 })
+}
+
+func compareRecord(a, b dnsmessage.Resource) int {
+	if ac, bc := a.Header.Class&^mdnsCacheFlush, b.Header.Class&^mdnsCacheFlush; ac != bc {
+		return int(ac) - int(bc)
+	}
+	if a.Header.Type != b.Header.Type {
+		return int(a.Header.Type) - int(b.Header.Type)
+	}
+	return bytes.Compare(rdata(a), rdata(b))
+}
+
+// rdata returns the data of the record types a responder owns, names lower cased
+func rdata(r dnsmessage.Resource) []byte {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return body.A[:]
+	case *dnsmessage.AAAAResource:
+		return body.AAAA[:]
+	case *dnsmessage.SRVResource:
+		b := []byte{byte(body.Priority >> 8), byte(body.Priority), byte(body.Weight >> 8), byte(body.Weight), byte(body.Port >> 8), byte(body.Port)}
+		return append(b, strings.ToLower(body.Target.String())...)
+	case *dnsmessage.TXTResource:
+		var b []byte
+		for _, txt := range body.TXT {
+			b = append(append(b, byte(len(txt))), txt...)
+		}
+		return b
+	}
+	return nil
+}
+
+// sendAll sends a message built for each interface of the connections
+func (m *mdnsResponder) sendAll(conns []PacketConn, build func(ifIndex int) []byte) {
+	for _, conn := range conns {
+		mc, ok := conn.(MultiConn)
+		if !ok || len(m.addrs) == 0 {
+			writeOn(conn, 0, build(0))
+			continue
+		}
+		for _, ifi := range mc.Interfaces() {
+			writeOn(conn, ifi.Index, build(ifi.Index))
+		}
+	}
+}
+
+// writeOn sends the message to the connection's group on the interface, or on the interface
+// the connection routes it to for index 0
+func writeOn(conn PacketConn, ifIndex int, b []byte) error {
+	group, ok := conn.Group().(*net.UDPAddr)
+	if !ok || ifIndex == 0 {
+		_, err := conn.WriteTo(b, conn.Group())
+		return err
+	}
+
+	var oob []byte
+	if group.IP.To4() != nil {
+		oob = (&ipv4.ControlMessage{IfIndex: ifIndex}).Marshal()
+	} else {
+		oob = (&ipv6.ControlMessage{IfIndex: ifIndex}).Marshal()
+	}
+	_, err := conn.WriteBatch([]BatchMessage{{Buffers: [][]byte{b}, OOB: oob, Addr: group}}, 0)
+	return err
+}
+
+// writeAll sends the message to the connection's group on each of its interfaces, a
+// connection routes a plain write out of only one of them
+func writeAll(conn PacketConn, b []byte) {
+	mc, ok := conn.(MultiConn)
+	if !ok {
+		writeOn(conn, 0, b)
+		return
+	}
+	for _, ifi := range mc.Interfaces() {
+		writeOn(conn, ifi.Index, b)
+	}
+}
+
+// answer returns the response to a query arriving on the interface, or nil if it doesn't ask
+// about the service. Only the host's addresses on the interface are given.
+func (m *mdnsResponder) answer(query []byte, ifIndex int) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || msg.Header.Response {
+		return nil
+	}
+
+	var answers, extra []dnsmessage.Resource
+	for _, q := range msg.Questions {
+		name := q.Name.String()
+		switch {
+		case strings.EqualFold(name, mdnsServicesType) && matchType(q.Type, dnsmessage.TypePTR):
+			answers = append(answers, ptrRecord(q.Name, dnsmessage.MustNewName(MDNSServiceType), mdnsTTL))
+		case strings.EqualFold(name, MDNSServiceType) && matchType(q.Type, dnsmessage.TypePTR):
+			answers = append(answers, m.ptr(mdnsTTL))
+			extra = append(extra, m.srv(mdnsTTL), m.txt(mdnsTTL))
+			extra = append(extra, m.hostRecords(mdnsTTL, ifIndex)...)
+		case strings.EqualFold(name, m.instance.String()):
+			if matchType(q.Type, dnsmessage.TypeSRV) {
+				answers = append(answers, m.srv(mdnsTTL))
+				extra = append(extra, m.hostRecords(mdnsTTL, ifIndex)...)
+			}
+			if matchType(q.Type, dnsmessage.TypeTXT) {
+				answers = append(answers, m.txt(mdnsTTL))
+			}
+		case strings.EqualFold(name, m.host.String()):
+			for _, r := range m.hostRecords(mdnsTTL, ifIndex) {
+				if matchType(q.Type, r.Header.Type) {
+					answers = append(answers, r)
+				}
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+	return m.response(answers, extra)
+}
+
+func (m *mdnsResponder) response(answers, extra []dnsmessage.Resource) []byte {
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: extra,
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+// all returns every record of the service, with the host's addresses on the interface
+func (m *mdnsResponder) all(ttl uint32, ifIndex int) []dnsmessage.Resource {
+	return append([]dnsmessage.Resource{m.ptr(ttl), m.srv(ttl), m.txt(ttl)}, m.hostRecords(ttl, ifIndex)...)
+}
+
+func (m *mdnsResponder) ptr(ttl uint32) dnsmessage.Resource {
+	return ptrRecord(dnsmessage.MustNewName(MDNSServiceType), m.instance, ttl)
+}
+
+func (m *mdnsResponder) srv(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: m.instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: m.host, Port: uint16(m.svc.Addr.Port)},
+	}
+}
+
+func (m *mdnsResponder) txt(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: m.instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl},
+		Body:   &dnsmessage.TXTResource{TXT: serviceTXT(m.svc.PeerURI)},
+	}
+}
+
+// hostRecords returns the host's address records on the interface, or on every interface for
+// index 0 and interfaces the responder doesn't know
+func (m *mdnsResponder) hostRecords(ttl uint32, ifIndex int) []dnsmessage.Resource {
+	addrs, ok := m.addrs[ifIndex]
+	if !ok {
+		for _, ifiAddrs := range m.addrs {
+			for _, ip := range ifiAddrs {
+				if !containsIP(addrs, ip) {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+	}
+
+	var records []dnsmessage.Resource
+	for _, ip := range addrs {
+		h := dnsmessage.ResourceHeader{Name: m.host, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			h.Type = dnsmessage.TypeA
+			records = append(records, dnsmessage.Resource{Header: h, Body: r})
+		} else {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			h.Type = dnsmessage.TypeAAAA
+			records = append(records, dnsmessage.Resource{Header: h, Body: r})
+		}
+	}
+	return records
+}
+
+// browseMDNS queries for services with backoff, reading answers until the connections close
+func browseMDNS(ctx context.Context, conns []PacketConn) <-chan DNSSDService {
+	out := make(chan DNSSDService, 16)
+
+	query, _ := (&dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(MDNSServiceType),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}).Pack()
+
+	go func() {
+		for interval := time.Second; ; interval *= 2 {
+			for _, conn := range conns {
+				writeAll(conn, query)
+			}
+
+			if interval > time.Minute {
+				interval = time.Minute
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+
+	found := make(chan DNSSDService)
+	for _, conn := range conns {
+		go func(conn PacketConn) {
+			buf := make([]byte, conn.MTU())
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				for _, svc := range parseServices(buf[:n]) {
+					select {
+					case found <- svc:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(conn)
+	}
+
+	go func() {
+		defer close(out)
+
+		seen := make(map[string]string)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case svc := <-found:
+				uri := svc.PeerURI.String()
+				if seen[svc.Instance] == uri {
+					continue
+				}
+				seen[svc.Instance] = uri
+
+				select {
+				case out <- svc:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// parseServices returns the mp2p services fully described by a response
+func parseServices(resp []byte) []DNSSDService {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || !msg.Header.Response {
+		return nil
+	}
+
+	records := append(msg.Answers, msg.Additionals...)
+	var services []DNSSDService
+	for _, r := range records {
+		ptr, ok := r.Body.(*dnsmessage.PTRResource)
+		if !ok || r.Header.TTL == 0 || !strings.EqualFold(r.Header.Name.String(), MDNSServiceType) {
+			continue
+		}
+
+		instance := ptr.PTR.String()
+		for _, r := range records {
+			txt, ok := r.Body.(*dnsmessage.TXTResource)
+			if !ok || !strings.EqualFold(r.Header.Name.String(), instance) {
+				continue
+			}
+
+			if uri, err := parseServiceTXT(txt.TXT); err == nil {
+				name := strings.TrimSuffix(instance, "."+MDNSServiceType)
+				services = append(services, DNSSDService{Instance: name, PeerURI: uri})
+			}
+		}
+	}
+	return services
+}
+
+// serviceTXT describes the peer in txt record key value pairs (RFC 6763 section 6)
+func serviceTXT(p PeerURI) []string {
+	return []string{
+		"txtvers=1",
+		"key=" + strings.ToLower(peerEncoding.EncodeToString(p.Key)),
+		"fp=" + fingerprint(p.Key),
+		"group=" + p.Addr.IP.String(),
+		"port=" + strconv.Itoa(p.Addr.Port),
+	}
+}
+
+func parseServiceTXT(txt []string) (PeerURI, error) {
+	values := make(map[string]string, len(txt))
+	for _, kv := range txt {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			values[strings.ToLower(kv[:i])] = kv[i+1:]
+		}
+	}
+
+	key, err := parsePeerKey(values["key"])
+	if err != nil {
+		return PeerURI{}, err
+	}
+
+	addr, err := parsePeerAddr(net.JoinHostPort(values["group"], values["port"]))
+	if err != nil {
+		return PeerURI{}, err
+	}
+	return PeerURI{Key: key, Addr: addr}, nil
+}
+
+// fingerprint is a short hex digest of a public key, for people to compare
+func fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func ptrRecord(name, ptr dnsmessage.Name, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: ptr},
+	}
+}
+
+func matchType(q, t dnsmessage.Type) bool {
+	return q == t || q == dnsmessage.TypeALL
+}
+
+// mdnsLabel makes a name usable as a single dns label
+func mdnsLabel(name string) string {
+	name = strings.ReplaceAll(name, ".", "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+// hostAddrs returns the unicast addresses of the connections' interfaces, by index
+func hostAddrs(conns []PacketConn) map[int][]net.IP {
+	addrs := make(map[int][]net.IP)
+	for _, conn := range conns {
+		mc, ok := conn.(MultiConn)
+		if !ok {
+			continue
+		}
+		for _, ifi := range mc.Interfaces() {
+			ifiAddrs, _ := ifi.Addrs()
+			for _, addr := range ifiAddrs {
+				if n, ok := addr.(*net.IPNet); ok && !containsIP(addrs[ifi.Index], n.IP) {
+					addrs[ifi.Index] = append(addrs[ifi.Index], n.IP)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// sameHostAddrs reports whether the host has the same addresses on each interface
+func sameHostAddrs(a, b map[int][]net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, ips := range a {
+		if len(ips) != len(b[i]) {
+			return false
+		}
+		for _, ip := range ips {
+			if !containsIP(b[i], ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMDNSResponder(t *testing.T) {
+	svc := DNSSDService{PeerURI: PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: net.ParseIP("ff1e::1234"), Port: 1024},
+	}}
+	m := newMDNSResponder(svc, map[int][]net.IP{1: {net.ParseIP("192.0.2.1")}, 2: {net.ParseIP("fd00::1")}})
+	if got := m.host.String(); got != "mp2p-"+fingerprint(svc.Key)+".local." {
+		t.Errorf("expected the host to be named by the key, got %s", got)
+	}
+
+	query := func(name string, typ dnsmessage.Type) []byte {
+		b, _ := (&dnsmessage.Message{Questions: []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET,
+		}}}).Pack()
+		return b
+	}
+
+	services := parseServices(m.answer(query("_MP2P._udp.local.", dnsmessage.TypePTR), 0))
+	if len(services) != 1 || services[0].Instance != "mp2p "+fingerprint(svc.Key) {
+		t.Fatalf("expected the service, got %v", services)
+	}
+	if got := services[0].PeerURI; !bytes.Equal(got.Key, svc.Key) || got.Addr.String() != svc.Addr.String() {
+		t.Errorf("expected %s, got %s", svc.PeerURI, got)
+	}
+
+	// Only the addresses of the interface a query arrived on are given
+	var msg dnsmessage.Message
+	if err := msg.Unpack(m.answer(query(m.host.String(), dnsmessage.TypeALL), 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.Type != dnsmessage.TypeAAAA {
+		t.Errorf("expected one aaaa record, got %v", msg.Answers)
+	}
+	if resp := m.answer(query(m.host.String(), dnsmessage.TypeAAAA), 1); resp != nil {
+		t.Error("expected no aaaa record on an ipv4 only interface")
+	}
+
+	if resp := m.answer(query("_http._tcp.local.", dnsmessage.TypePTR), 0); resp != nil {
+		t.Error("expected no answer for other services")
+	}
+
+	// Goodbyes don't describe services
+	if services := parseServices(m.response(m.all(0, 0), nil)); len(services) != 0 {
+		t.Errorf("expected no services from a goodbye, got %v", services)
+	}
+}
+
+func TestBrowseMDNS(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	svc := DNSSDService{Instance: "test.node", PeerURI: PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m := newMDNSResponder(svc, nil)
+	m.probeInterval = time.Millisecond
+	go m.serve(ctx, []PacketConn{a}, nil)
+	found := browseMDNS(ctx, []PacketConn{b})
+
+	got := <-found
+	if got.Instance != "test-node" || !bytes.Equal(got.Key, svc.Key) || !got.Addr.IP.Equal(svc.Addr.IP) {
+		t.Errorf("expected %s, got %s %s", svc.PeerURI, got.Instance, got.PeerURI)
+	}
+}
+
+func TestMDNSProbe(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	defer a.Close()
+
+	svc := DNSSDService{PeerURI: PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+	}}
+	m := newMDNSResponder(svc, nil)
+	m.probeInterval = 10 * time.Millisecond
+	instance := m.instance
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go m.serve(ctx, []PacketConn{a}, nil)
+
+	b.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, b.MTU())
+	n, _, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var probe dnsmessage.Message
+	if err := probe.Unpack(buf[:n]); err != nil || probe.Header.Response || len(probe.Authorities) == 0 {
+		t.Fatalf("expected a probe before announcing, got %+v (%v)", probe, err)
+	}
+
+	// The node's own probe looping back doesn't conflict
+	a.deliver(pkt{data: append([]byte(nil), buf[:n]...), addr: b.addr})
+
+	// Another responder already owns the instance name
+	taken, _ := (&dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: mdnsTTL},
+			Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("other.local."), Port: 1},
+		}},
+	}).Pack()
+	b.WriteTo(taken, a.addr)
+
+	for {
+		n, _, err := b.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if services := parseServices(buf[:n]); len(services) > 0 {
+			if got, want := services[0].Instance, svc.Instance+"mp2p "+fingerprint(svc.Key)+" (2)"; got != want {
+				t.Errorf("expected the service renamed to %q, got %q", want, got)
+			}
+			return
+		}
+	}
+}
+
+func TestMDNSReannounce(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	defer a.Close()
+
+	svc := DNSSDService{PeerURI: PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+	}}
+	m := newMDNSResponder(svc, map[int][]net.IP{1: {net.ParseIP("192.0.2.1")}})
+	m.probeInterval, m.announceInterval = time.Millisecond, 5*time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events := make(chan NetEvent, 1)
+	go m.serve(ctx, []PacketConn{a}, events)
+
+	// announcements reads the next n announcements, reporting whether any gave an address
+	buf := make([]byte, b.MTU())
+	announcements := func(n int) (addrs bool) {
+		b.SetDeadline(time.Now().Add(time.Second))
+		for n > 0 {
+			size, _, err := b.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:size]); err != nil || !msg.Header.Response {
+				continue
+			}
+			n--
+			for _, r := range append(msg.Answers, msg.Additionals...) {
+				addrs = addrs || r.Header.Type == dnsmessage.TypeA
+			}
+		}
+		return addrs
+	}
+
+	if !announcements(2) {
+		t.Error("expected the address to be announced")
+	}
+
+	// The conn has no interfaces, so the address is gone once the network changes
+	events <- NetEvent{Kind: AddressRemoved}
+	if announcements(2) {
+		t.Error("expected the removed address not to be announced again")
+	}
+}
+
+func TestMDNSConflict(t *testing.T) {
+	svc := DNSSDService{PeerURI: PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+	}}
+	m := newMDNSResponder(svc, map[int][]net.IP{1: {net.ParseIP("192.0.2.1")}, 2: {net.ParseIP("192.0.2.2")}})
+
+	if c := m.conflict(m.probeQuery(1)); c != (mdnsConflict{}) {
+		t.Errorf("expected no conflict with the node's own probe, got %+v", c)
+	}
+	if c := m.conflict(m.response(m.all(mdnsTTL, 0), nil)); c != (mdnsConflict{}) {
+		t.Errorf("expected no conflict with the node's own announcement, got %+v", c)
+	}
+
+	// Simultaneous probes for the host, the later address wins
+	for _, test := range []struct {
+		addr string
+		lost bool
+	}{{"192.0.2.255", true}, {"192.0.2.0", false}} {
+		other := newMDNSResponder(svc, map[int][]net.IP{1: {net.ParseIP(test.addr)}})
+		other.instance = dnsmessage.MustNewName("other." + MDNSServiceType)
+		if c := m.conflict(other.probeQuery(1)); c != (mdnsConflict{lost: test.lost}) {
+			t.Errorf("expected a probe with %s to be lost %v, got %+v", test.addr, test.lost, c)
+		}
+	}
+}
+
+func TestRendezvousMDNS(t *testing.T) {
+	multicastIfi(t)
+
+	r := Rendezvous{Groups: MDNSRendezvous.Groups, Port: 20005}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	found, err := r.BrowseMDNS(ctx)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	svc := DNSSDService{PeerURI: PeerURI{
+		Key:  testKey(2).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024},
+	}}
+	if err := r.AdvertiseMDNS(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := <-found
+	if !ok {
+		t.Fatal("expected to browse the advertised service")
+	}
+	if !bytes.Equal(got.Key, svc.Key) {
+		t.Errorf("expected %x, got %x", []byte(svc.Key), []byte(got.Key))
+	}
+}
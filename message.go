@@ -1,16 +1,18 @@
 package mp2p
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
-	"unsafe"
+	"reflect"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/curve25519"
 )
@@ -19,41 +21,209 @@ const (
 	TypeAddressDeclaration uint8 = iota
 	TypeSessionInitiation
 	TypeSessionData
+
+	// TypeMembershipProbe is sent by a MembershipMonitor to its own group, and consumed by it
+	TypeMembershipProbe
+
+	// TypeAnnouncement is sent to rendezvous groups so nodes on the local network can be
+	// discovered
+	TypeAnnouncement
+)
+
+// Encoded message lengths
+const (
+	AddressDeclarationLen = 1 + 2 + 16 + 32 + ed25519.SignatureSize
+	SessionInitiationLen  = 1 + 16 + 32 + 32 + 32 + ed25519.SignatureSize
+	MembershipProbeLen    = 1 + 16 + 4 + probeMACLen
+
+	// AnnouncementMinLen is the length of an announcement without service tags
+	AnnouncementMinLen = 1 + 2 + 16 + 32 + 8 + 1 + ed25519.SignatureSize
+
+	// MaxMessageLen is the largest udp payload a message can be sent in
+	MaxMessageLen = 65535 - udpHeaderLen
+)
+
+var (
+	// ErrShortMessage is returned when decoding a message that has been truncated
+	ErrShortMessage = errors.New("short message")
+
+	// ErrTrailingBytes is returned when decoding a message followed by extra data
+	ErrTrailingBytes = errors.New("trailing bytes after message")
+
+	// ErrOversizedMessage is returned when decoding a message too large to have been sent
+	ErrOversizedMessage = errors.New("oversized message")
+
+	// ErrWrongType is returned when decoding a message of a different type
+	ErrWrongType = errors.New("wrong message type")
+)
+
+var (
+	_ encoding.BinaryUnmarshaler = (*AddressDeclarationPayload)(nil)
+	_ encoding.BinaryUnmarshaler = (*SessionInitiationPayload)(nil)
+	_ encoding.BinaryUnmarshaler = (*SessionDataPayload)(nil)
+	_ encoding.BinaryUnmarshaler = (*AnnouncementPayload)(nil)
+	_ encoding.BinaryUnmarshaler = (*MembershipProbePayload)(nil)
+
+	_ encoding.BinaryMarshaler = AddressDeclarationPayload{}
+	_ encoding.BinaryMarshaler = SessionInitiationPayload{}
+	_ encoding.BinaryMarshaler = SessionDataPayload{}
+	_ encoding.BinaryMarshaler = AnnouncementPayload{}
+	_ encoding.BinaryMarshaler = MembershipProbePayload{}
+
+	_ Message = AddressDeclarationPayload{}
+	_ Message = SessionInitiationPayload{}
+	_ Message = SessionDataPayload{}
+	_ Message = AnnouncementPayload{}
+	_ Message = MembershipProbePayload{}
+)
+
+// TypeUser is the first message type available to applications, types below it are
+// reserved for mp2p
+const TypeUser uint8 = 0x80
+
+// Message is a message sent between nodes, identified on the wire by its first byte
+type Message interface {
+	Type() uint8
+	MarshalBinary() ([]byte, error)
+	Validate() bool
+}
+
+// MessageParser parses a message of a registered type, including the type byte
+type MessageParser func(data []byte) (Message, error)
+
+// MessageMarshaler encodes a message of a registered type, including the type byte
+type MessageMarshaler func(m Message) ([]byte, error)
+
+// messageCodec is how a registered message type is parsed and marshaled, a nil marshaler
+// uses the message's own MarshalBinary method
+type messageCodec struct {
+	parse   MessageParser
+	marshal MessageMarshaler
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]messageCodec{
+		TypeAddressDeclaration: {parse: func(data []byte) (Message, error) {
+			return ParseAddressDeclarationPayload(data)
+		}},
+		TypeSessionInitiation: {parse: func(data []byte) (Message, error) {
+			return ParseSessionInitiationPayload(data)
+		}},
+		TypeSessionData: {parse: func(data []byte) (Message, error) {
+			return ParseSessionDataPayload(data)
+		}},
+		TypeAnnouncement: {parse: func(data []byte) (Message, error) {
+			return ParseAnnouncementPayload(data)
+		}},
+		TypeMembershipProbe: {parse: func(data []byte) (Message, error) {
+			return ParseMembershipProbePayload(data)
+		}},
+	}
 )
 
-func ParseMessage(data []byte) (interface{}, error) {
+// RegisterMessage registers the parser and marshaler for an application message type. The
+// marshaler may be nil, in which case messages are marshaled by their own MarshalBinary.
+func RegisterMessage(t uint8, parse MessageParser, marshal MessageMarshaler) error {
+	if t < TypeUser {
+		return fmt.Errorf("message type %d is reserved", t)
+	}
+	if parse == nil {
+		return errors.New("nil message parser")
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecs[t]; ok {
+		return fmt.Errorf("message type %d already registered", t)
+	}
+	codecs[t] = messageCodec{parse: parse, marshal: marshal}
+	return nil
+}
+
+// ParseMessage parses a message with the parser registered for its type
+func ParseMessage(data []byte) (Message, error) {
 	if len(data) == 0 {
 		return nil, errors.New("cannot parse empty message")
 	}
 
-	// Session Initiation
-	switch data[0] {
-	case TypeSessionInitiation:
-		return ParseSessionInitiationPayload(data)
-	case TypeAddressDeclaration:
-		return ParseAddressDeclarationPayload(data)
-	case TypeSessionData:
-		return ParseSessionDataPayload(data)
+	codecsMu.RLock()
+	codec, ok := codecs[data[0]]
+	codecsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %d", data[0])
 	}
 
-	return nil, fmt.Errorf("unsupported protocol %d", data[0])
+	m, err := codec.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if isNil(m) {
+		return nil, fmt.Errorf("parser for message type %d returned no message", data[0])
+	}
+	return m, nil
+}
+
+// MarshalMessage encodes a message with the marshaler registered for its type, checking the
+// encoding starts with the type byte
+func MarshalMessage(m Message) ([]byte, error) {
+	if isNil(m) {
+		return nil, errors.New("cannot marshal nil message")
+	}
+
+	codecsMu.RLock()
+	codec, ok := codecs[m.Type()]
+	codecsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %d", m.Type())
+	}
+
+	marshal := codec.marshal
+	if marshal == nil {
+		marshal = Message.MarshalBinary
+	}
+
+	data, err := marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || data[0] != m.Type() {
+		return nil, fmt.Errorf("marshaled message does not start with its type %d", m.Type())
+	}
+	return data, nil
+}
+
+// isNil reports whether m is nil, including a nil pointer wrapped in the interface
+func isNil(m Message) bool {
+	if m == nil {
+		return true
+	}
+	v := reflect.ValueOf(m)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
 }
 
 type AddressDeclarationPayload struct {
-	Type      uint8
-	Port      uint16
-	Address   [16]byte
-	Src       [32]byte
-	Signature [ed25519.SignatureSize]byte
+	MessageType uint8
+	Port        uint16
+	Address     [16]byte
+	Src         [32]byte
+	Signature   [ed25519.SignatureSize]byte
 }
 
 func ParseAddressDeclarationPayload(data []byte) (p AddressDeclarationPayload, err error) {
-	return p, binary.Read(bytes.NewReader(data), binary.BigEndian, &p)
+	return p, p.UnmarshalBinary(data)
 }
 
 func NewAddressDeclarationPayload(addr net.UDPAddr, key ed25519.PrivateKey) (p AddressDeclarationPayload) {
 
-	p.Type = TypeAddressDeclaration
+	p.MessageType = TypeAddressDeclaration
 	p.Port = uint16(addr.Port)
 
 	copy(p.Address[:], addr.IP.To16())
@@ -65,31 +235,65 @@ func NewAddressDeclarationPayload(addr net.UDPAddr, key ed25519.PrivateKey) (p A
 	return
 }
 
-func (p AddressDeclarationPayload) Bytes() (d []byte) {
-	w := bytes.NewBuffer(make([]byte, 0, unsafe.Sizeof(p)))
-	binary.Write(w, binary.BigEndian, p)
-	return w.Bytes()
+func (p AddressDeclarationPayload) Bytes() []byte {
+	b, _ := p.MarshalBinary()
+	return b
+}
+
+func (p AddressDeclarationPayload) Type() uint8 {
+	return TypeAddressDeclaration
+}
+
+func (p AddressDeclarationPayload) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(make([]byte, 0, AddressDeclarationLen))
+}
+
+// AppendBinary appends the encoded payload to b
+func (p AddressDeclarationPayload) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, p.MessageType, byte(p.Port>>8), byte(p.Port))
+	b = append(b, p.Address[:]...)
+	b = append(b, p.Src[:]...)
+	return append(b, p.Signature[:]...), nil
 }
 
+func (p *AddressDeclarationPayload) UnmarshalBinary(data []byte) error {
+	if err := checkLen("address declaration", data, TypeAddressDeclaration, AddressDeclarationLen, AddressDeclarationLen); err != nil {
+		return err
+	}
+
+	p.MessageType = data[0]
+	p.Port = binary.BigEndian.Uint16(data[1:3])
+	data = data[3:]
+	data = data[copy(p.Address[:], data):]
+	data = data[copy(p.Src[:], data):]
+	copy(p.Signature[:], data)
+	return nil
+}
+
+// Validate checks the declared address is a valid group, and the signature of the declaration
 func (p AddressDeclarationPayload) Validate() bool {
+	if !ClassifyGroup(net.IP(p.Address[:])).Valid {
+		return false
+	}
+
 	data := p.Bytes()
 	return ed25519.Verify(p.Src[:], data[:len(data)-ed25519.SignatureSize], p.Signature[:])
 }
 
 type SessionInitiationPayload struct {
-	Type       uint8
-	SessionID  [16]byte
-	Src, Dst   [32]byte
-	SessionKey [32]byte
-	Signature  [ed25519.SignatureSize]byte
+	MessageType uint8
+	SessionID   [16]byte
+	Src, Dst    [32]byte
+	SessionKey  [32]byte
+	Signature   [ed25519.SignatureSize]byte
 }
 
 func ParseSessionInitiationPayload(data []byte) (p SessionInitiationPayload, err error) {
-	return p, binary.Read(bytes.NewReader(data), binary.BigEndian, &p)
+	return p, p.UnmarshalBinary(data)
 }
 
 func NewSessionInitiationPayload(src ed25519.PrivateKey, dst ed25519.PublicKey, sessID []byte) (p SessionInitiationPayload, priv [32]byte, err error) {
-	p.Type = TypeSessionInitiation
+	p.MessageType = TypeSessionInitiation
 
 	if len(sessID) == 16 {
 		copy(p.SessionID[:], sessID)
@@ -111,9 +315,41 @@ func NewSessionInitiationPayload(src ed25519.PrivateKey, dst ed25519.PublicKey,
 }
 
 func (p SessionInitiationPayload) Bytes() []byte {
-	w := bytes.NewBuffer(make([]byte, 0, unsafe.Sizeof(p)))
-	binary.Write(w, binary.BigEndian, p)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
+}
+
+func (p SessionInitiationPayload) Type() uint8 {
+	return TypeSessionInitiation
+}
+
+func (p SessionInitiationPayload) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(make([]byte, 0, SessionInitiationLen))
+}
+
+// AppendBinary appends the encoded payload to b
+func (p SessionInitiationPayload) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, p.MessageType)
+	b = append(b, p.SessionID[:]...)
+	b = append(b, p.Src[:]...)
+	b = append(b, p.Dst[:]...)
+	b = append(b, p.SessionKey[:]...)
+	return append(b, p.Signature[:]...), nil
+}
+
+func (p *SessionInitiationPayload) UnmarshalBinary(data []byte) error {
+	if err := checkLen("session initiation", data, TypeSessionInitiation, SessionInitiationLen, SessionInitiationLen); err != nil {
+		return err
+	}
+
+	p.MessageType = data[0]
+	data = data[1:]
+	data = data[copy(p.SessionID[:], data):]
+	data = data[copy(p.Src[:], data):]
+	data = data[copy(p.Dst[:], data):]
+	data = data[copy(p.SessionKey[:], data):]
+	copy(p.Signature[:], data)
+	return nil
 }
 
 func (p SessionInitiationPayload) Validate() bool {
@@ -122,30 +358,33 @@ func (p SessionInitiationPayload) Validate() bool {
 }
 
 type SessionDataPayload struct {
-	Type      uint8
-	SessionID [16]byte
-	Nonce     [12]byte
-	Data      []byte
+	MessageType uint8
+	SessionID   [16]byte
+	Nonce       [12]byte
+	Data        []byte
 }
 
 func ParseSessionDataPayload(data []byte) (p SessionDataPayload, err error) {
-	if len(data) < 1+16+12 {
-		return p, errors.New("no data")
-	}
-
-	r := bytes.NewReader(data)
-	p.Type, _ = r.ReadByte()
-	r.Read(p.SessionID[:])
-	r.Read(p.Nonce[:])
+	return p, p.UnmarshalBinary(data)
+}
 
-	p.Data = make([]byte, len(data)-(1+16+12))
-	r.Read(p.Data)
+// ParseSessionDataPayloadInPlace is ParseSessionDataPayload without copying the ciphertext,
+// the payload's Data aliases data. With reused read buffers and Session.HandleDatagram, reads
+// don't allocate.
+func ParseSessionDataPayloadInPlace(data []byte) (p SessionDataPayload, err error) {
+	if err := checkLen("session data", data, TypeSessionData, sessionHeaderLen+gcmTagLen, MaxMessageLen); err != nil {
+		return p, err
+	}
 
-	return
+	p.MessageType = data[0]
+	copy(p.SessionID[:], data[1:17])
+	copy(p.Nonce[:], data[17:sessionHeaderLen])
+	p.Data = data[sessionHeaderLen:]
+	return p, nil
 }
 
 func NewSessionDataPayload(sessKey []byte, sessID [16]byte, data []byte) (p SessionDataPayload) {
-	p.Type = TypeSessionData
+	p.MessageType = TypeSessionData
 	p.SessionID = sessID
 	rand.Read(p.Nonce[:])
 
@@ -153,17 +392,51 @@ func NewSessionDataPayload(sessKey []byte, sessID [16]byte, data []byte) (p Sess
 	return
 }
 
+// AppendSessionData seals data and appends it to dst as an encoded session data payload.
+// The data may be stored in dst's spare capacity right after the payload header, in which
+// case it is encrypted in place.
+func AppendSessionData(dst []byte, aead cipher.AEAD, sessID [16]byte, data []byte) ([]byte, error) {
+	if aead.NonceSize() != len(SessionDataPayload{}.Nonce) {
+		return dst, fmt.Errorf("unsupported nonce size %d", aead.NonceSize())
+	}
+	if sessionHeaderLen+len(data)+aead.Overhead() > MaxMessageLen {
+		return dst, fmt.Errorf("%w: session data of %d bytes", ErrOversizedMessage, len(data))
+	}
+
+	dst = append(dst, TypeSessionData)
+	dst = append(dst, sessID[:]...)
+	dst = append(dst, zeroNonce[:]...)
+
+	nonce := dst[len(dst)-len(zeroNonce):]
+	if _, err := rand.Read(nonce); err != nil {
+		return dst, err
+	}
+
+	return aead.Seal(dst, nonce, data, nil), nil
+}
+
+var zeroNonce [12]byte
+
 func (p SessionDataPayload) Decrypt(sessKey []byte) ([]byte, error) {
 	return toCipher(sessKey).Open(nil, p.Nonce[:], p.Data, nil)
 }
 
-func toCipher(sessKey []byte) cipher.AEAD {
+// Open decrypts the payload in place with a cached session cipher, overwriting p.Data
+func (p SessionDataPayload) Open(aead cipher.AEAD) ([]byte, error) {
+	return aead.Open(p.Data[:0], p.Nonce[:], p.Data, nil)
+}
+
+// NewSessionCipher creates the AEAD used to seal and open session data with the session key
+func NewSessionCipher(sessKey []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(sessKey)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func toCipher(sessKey []byte) cipher.AEAD {
+	aesgcm, err := NewSessionCipher(sessKey)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -172,12 +445,237 @@ func toCipher(sessKey []byte) cipher.AEAD {
 }
 
 func (p SessionDataPayload) Bytes() []byte {
+	b, _ := p.MarshalBinary()
+	return b
+}
+
+func (p SessionDataPayload) Type() uint8 {
+	return TypeSessionData
+}
+
+func (p SessionDataPayload) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(make([]byte, 0, sessionHeaderLen+len(p.Data)))
+}
+
+// AppendBinary appends the encoded payload to b
+func (p SessionDataPayload) AppendBinary(b []byte) ([]byte, error) {
+	if sessionHeaderLen+len(p.Data) > MaxMessageLen {
+		return b, fmt.Errorf("%w: session data of %d bytes", ErrOversizedMessage, len(p.Data))
+	}
+
+	b = append(b, p.MessageType)
+	b = append(b, p.SessionID[:]...)
+	b = append(b, p.Nonce[:]...)
+	return append(b, p.Data...), nil
+}
+
+// UnmarshalBinary decodes the payload, copying the ciphertext out of data
+func (p *SessionDataPayload) UnmarshalBinary(data []byte) error {
+	if err := checkLen("session data", data, TypeSessionData, sessionHeaderLen+gcmTagLen, MaxMessageLen); err != nil {
+		return err
+	}
+
+	p.MessageType = data[0]
+	data = data[1:]
+	data = data[copy(p.SessionID[:], data):]
+	data = data[copy(p.Nonce[:], data):]
+	p.Data = append(p.Data[:0], data...)
+	return nil
+}
+
+// Validate checks the payload is well formed, its authenticity is only known once decrypted
+func (p SessionDataPayload) Validate() bool {
+	return p.MessageType == TypeSessionData && len(p.Data) >= gcmTagLen
+}
+
+// AnnouncementPayload is a signed declaration of a node's address and services, sent to a
+// rendezvous group for discovery
+type AnnouncementPayload struct {
+	MessageType uint8
+	Port        uint16
+	Address     [16]byte
+	Src         [32]byte
+
+	// Time is when the announcement was made, in unix seconds
+	Time uint64
+
+	// Tags name the services of the node, at most 255 of up to 255 bytes each
+	Tags []string
+
+	Signature [ed25519.SignatureSize]byte
+}
+
+func ParseAnnouncementPayload(data []byte) (p AnnouncementPayload, err error) {
+	return p, p.UnmarshalBinary(data)
+}
+
+// NewAnnouncementPayload signs an announcement of the address and service tags
+func NewAnnouncementPayload(addr net.UDPAddr, tags []string, key ed25519.PrivateKey) (p AnnouncementPayload, err error) {
+	if len(tags) > 255 {
+		return p, fmt.Errorf("%d service tags, at most 255 allowed", len(tags))
+	}
+	for _, tag := range tags {
+		if len(tag) > 255 {
+			return p, fmt.Errorf("service tag %.16q... is longer than 255 bytes", tag)
+		}
+	}
+
+	p.MessageType = TypeAnnouncement
+	p.Port = uint16(addr.Port)
+	p.Time = uint64(time.Now().Unix())
+	p.Tags = tags
+
+	copy(p.Address[:], addr.IP.To16())
+	copy(p.Src[:], key.Public().(ed25519.PublicKey))
+
+	data := p.Bytes()
+	copy(p.Signature[:], ed25519.Sign(key, data[:len(data)-ed25519.SignatureSize]))
+
+	return p, nil
+}
 
-	w := bytes.NewBuffer(make([]byte, 0, int(unsafe.Sizeof(p))+len(p.Data)))
-	w.WriteByte(p.Type)
-	w.Write(p.SessionID[:])
-	w.Write(p.Nonce[:])
-	w.Write(p.Data)
+func (p AnnouncementPayload) Bytes() []byte {
+	b, _ := p.MarshalBinary()
+	return b
+}
+
+func (p AnnouncementPayload) Type() uint8 {
+	return TypeAnnouncement
+}
+
+func (p AnnouncementPayload) MarshalBinary() ([]byte, error) {
+	n := AnnouncementMinLen
+	for _, tag := range p.Tags {
+		n += 1 + len(tag)
+	}
+	return p.AppendBinary(make([]byte, 0, n))
+}
+
+// AppendBinary appends the encoded payload to b
+func (p AnnouncementPayload) AppendBinary(b []byte) ([]byte, error) {
+	if len(p.Tags) > 255 {
+		return b, fmt.Errorf("%w: announcement with %d tags", ErrOversizedMessage, len(p.Tags))
+	}
+
+	b = append(b, p.MessageType, byte(p.Port>>8), byte(p.Port))
+	b = append(b, p.Address[:]...)
+	b = append(b, p.Src[:]...)
+	b = append(b, byte(p.Time>>56), byte(p.Time>>48), byte(p.Time>>40), byte(p.Time>>32),
+		byte(p.Time>>24), byte(p.Time>>16), byte(p.Time>>8), byte(p.Time))
+
+	b = append(b, byte(len(p.Tags)))
+	for _, tag := range p.Tags {
+		if len(tag) > 255 {
+			return b, fmt.Errorf("%w: announcement tag of %d bytes", ErrOversizedMessage, len(tag))
+		}
+		b = append(b, byte(len(tag)))
+		b = append(b, tag...)
+	}
+	return append(b, p.Signature[:]...), nil
+}
 
-	return w.Bytes()
+func (p *AnnouncementPayload) UnmarshalBinary(data []byte) error {
+	if err := checkLen("announcement", data, TypeAnnouncement, AnnouncementMinLen, MaxMessageLen); err != nil {
+		return err
+	}
+
+	p.MessageType = data[0]
+	p.Port = binary.BigEndian.Uint16(data[1:3])
+	data = data[3:]
+	data = data[copy(p.Address[:], data):]
+	data = data[copy(p.Src[:], data):]
+	p.Time = binary.BigEndian.Uint64(data)
+
+	count := int(data[8])
+	data = data[9:]
+
+	p.Tags = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 1 || len(data) < 1+int(data[0])+ed25519.SignatureSize {
+			return fmt.Errorf("%w: announcement tags", ErrShortMessage)
+		}
+		p.Tags = append(p.Tags, string(data[1:1+data[0]]))
+		data = data[1+data[0]:]
+	}
+
+	if len(data) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: announcement has %d extra bytes", ErrTrailingBytes, len(data)-ed25519.SignatureSize)
+	}
+	copy(p.Signature[:], data)
+	return nil
+}
+
+// Validate checks the announced address is a valid group, and the signature of the
+// announcement
+func (p AnnouncementPayload) Validate() bool {
+	if !ClassifyGroup(net.IP(p.Address[:])).Valid {
+		return false
+	}
+
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(p.Src[:], data[:len(data)-ed25519.SignatureSize], p.Signature[:])
+}
+
+// MembershipProbePayload is a probe a MembershipMonitor sends to its own group. Other nodes on
+// the group parse it only to recognise and drop it, the mac can only be checked by the
+// monitor which sent it.
+type MembershipProbePayload struct {
+	MessageType uint8
+	Token       [16]byte
+	Seq         uint32
+	MAC         [probeMACLen]byte
+}
+
+func ParseMembershipProbePayload(data []byte) (p MembershipProbePayload, err error) {
+	return p, p.UnmarshalBinary(data)
+}
+
+func (p MembershipProbePayload) Type() uint8 {
+	return TypeMembershipProbe
+}
+
+func (p MembershipProbePayload) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, MembershipProbeLen)
+	b = append(b, p.MessageType)
+	b = append(b, p.Token[:]...)
+	b = append(b, byte(p.Seq>>24), byte(p.Seq>>16), byte(p.Seq>>8), byte(p.Seq))
+	return append(b, p.MAC[:]...), nil
+}
+
+func (p *MembershipProbePayload) UnmarshalBinary(data []byte) error {
+	if err := checkLen("membership probe", data, TypeMembershipProbe, MembershipProbeLen, MembershipProbeLen); err != nil {
+		return err
+	}
+
+	p.MessageType = data[0]
+	copy(p.Token[:], data[1:17])
+	p.Seq = binary.BigEndian.Uint32(data[17:21])
+	copy(p.MAC[:], data[21:])
+	return nil
+}
+
+// Validate checks the probe is well formed, its mac is only checked by the monitor which
+// sent it
+func (p MembershipProbePayload) Validate() bool {
+	return p.MessageType == TypeMembershipProbe
+}
+
+// checkLen checks data holds a message of the given type, between min and max bytes long
+func checkLen(name string, data []byte, t uint8, min, max int) error {
+	if len(data) < min {
+		return fmt.Errorf("%w: %s needs %d bytes, got %d", ErrShortMessage, name, min, len(data))
+	}
+	if data[0] != t {
+		return fmt.Errorf("%w: expected %s (%d), got %d", ErrWrongType, name, t, data[0])
+	}
+	if len(data) > max && min == max {
+		return fmt.Errorf("%w: %s has %d extra bytes", ErrTrailingBytes, name, len(data)-max)
+	}
+	if len(data) > max {
+		return fmt.Errorf("%w: %s of %d bytes", ErrOversizedMessage, name, len(data))
+	}
+	return nil
 }
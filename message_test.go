@@ -3,6 +3,7 @@ package mp2p
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"testing"
@@ -16,3 +17,133 @@ func TestDecl(t *testing.T) {
 	fmt.Println(d)
 	fmt.Println(d.Validate())
 }
+
+type pingMessage struct {
+	seq uint8
+}
+
+func (m pingMessage) Type() uint8                    { return TypeUser + 1 }
+func (m pingMessage) MarshalBinary() ([]byte, error) { return []byte{m.Type(), m.seq}, nil }
+func (m pingMessage) Validate() bool                 { return true }
+
+func TestRegisterMessage(t *testing.T) {
+	err := RegisterMessage(TypeUser+1, func(data []byte) (Message, error) {
+		if len(data) != 2 {
+			return nil, fmt.Errorf("bad ping length %d", len(data))
+		}
+		return pingMessage{seq: data[1]}, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := MarshalMessage(pingMessage{seq: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, ok := msg.(pingMessage); !ok || ping.seq != 7 {
+		t.Errorf("expected ping 7, got %+v", msg)
+	}
+
+	if err := RegisterMessage(TypeUser+1, func(data []byte) (Message, error) { return nil, nil }, nil); err == nil {
+		t.Error("expected duplicate registration to fail")
+	}
+	if err := RegisterMessage(TypeSessionData, func(data []byte) (Message, error) { return nil, nil }, nil); err == nil {
+		t.Error("expected reserved registration to fail")
+	}
+	if _, err := ParseMessage([]byte{TypeUser + 2}); err == nil {
+		t.Error("expected unregistered type to fail")
+	}
+}
+
+type pongMessage struct {
+	seq uint8
+}
+
+func (m pongMessage) Type() uint8                    { return TypeUser + 3 }
+func (m pongMessage) MarshalBinary() ([]byte, error) { return nil, errors.New("unused") }
+func (m pongMessage) Validate() bool                 { return true }
+
+func TestRegisterMessageMarshaler(t *testing.T) {
+	err := RegisterMessage(TypeUser+3, func(data []byte) (Message, error) {
+		if len(data) == 1 {
+			return nil, nil
+		}
+		if data[1] == 0 {
+			return (*pongMessage)(nil), nil
+		}
+		return pongMessage{seq: data[1]}, nil
+	}, func(m Message) ([]byte, error) {
+		return []byte{m.Type(), m.(pongMessage).seq}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := MarshalMessage(pongMessage{seq: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ParseMessage(data); err != nil || msg.(pongMessage).seq != 9 {
+		t.Errorf("expected pong 9, got %+v %v", msg, err)
+	}
+
+	// Parsers must return a message or an error
+	if msg, err := ParseMessage([]byte{TypeUser + 3}); err == nil {
+		t.Errorf("expected a nil message to fail, got %+v", msg)
+	}
+	if msg, err := ParseMessage([]byte{TypeUser + 3, 0}); err == nil {
+		t.Errorf("expected a nil pointer message to fail, got %+v", msg)
+	}
+	if _, err := MarshalMessage((*pongMessage)(nil)); err == nil {
+		t.Error("expected marshaling a nil pointer message to fail")
+	}
+}
+
+func TestMessageLengths(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	decl := NewAddressDeclarationPayload(net.UDPAddr{IP: NewIPv6(), Port: 1025}, key)
+	init, _, _ := NewSessionInitiationPayload(key, key.Public().(ed25519.PublicKey), nil)
+	data := NewSessionDataPayload(make([]byte, 32), init.SessionID, []byte("hello"))
+
+	for _, msg := range []Message{decl, init, data} {
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseMessage(b)
+		if err != nil {
+			t.Fatalf("failed to parse %T: %v", msg, err)
+		}
+		if !parsed.Validate() {
+			t.Errorf("parsed %T failed to validate", msg)
+		}
+
+		if _, err := ParseMessage(b[:len(b)-17]); !errors.Is(err, ErrShortMessage) {
+			t.Errorf("expected ErrShortMessage for truncated %T, got %v", msg, err)
+		}
+	}
+
+	if _, err := ParseMessage(append(decl.Bytes(), 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("expected ErrTrailingBytes, got %v", err)
+	}
+	if _, err := ParseMessage(append(init.Bytes(), 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("expected ErrTrailingBytes, got %v", err)
+	}
+	if _, err := ParseMessage(append(data.Bytes(), make([]byte, MaxMessageLen)...)); !errors.Is(err, ErrOversizedMessage) {
+		t.Errorf("expected ErrOversizedMessage, got %v", err)
+	}
+
+	var p SessionInitiationPayload
+	if err := p.UnmarshalBinary(decl.Bytes()); !errors.Is(err, ErrShortMessage) {
+		t.Errorf("expected ErrShortMessage, got %v", err)
+	}
+	if p != (SessionInitiationPayload{}) {
+		t.Errorf("expected failed decode to leave payload empty, got %+v", p)
+	}
+}
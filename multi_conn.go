@@ -0,0 +1,497 @@
+package mp2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MultiConn is a PacketConn joined on any number of interfaces, which can join and leave
+// additional groups at runtime
+type MultiConn interface {
+	PacketConn
+	JoinGroup(group net.IP) error
+	LeaveGroup(group net.IP) error
+	Interfaces() []*net.Interface
+
+	// Rejoin joins every group again on every interface, after the kernel dropped the
+	// memberships because an interface went down or was replaced
+	Rejoin() error
+
+	// JoinInterfaces joins the connection's groups on interfaces that have become eligible
+	// since it was created, returning the interfaces joined. Only connections created by
+	// NewMultiConn grow, others return nothing.
+	JoinInterfaces() ([]*net.Interface, error)
+}
+
+// NewMultiConn creates a packet connection joined to the group on every eligible interface
+// passing the connection's interface filters. Interfaces which fail to join the group are
+// left out.
+func NewMultiConn(group net.IP, port int, opts ...ConnOption) (MultiConn, error) {
+	cfg := newConnConfig(opts)
+
+	candidates, err := RankInterfaces(group, cfg.filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifis []*net.Interface
+	for i := range candidates {
+		if candidates[i].Eligible() {
+			ifis = append(ifis, &candidates[i].Interface)
+		}
+	}
+
+	if len(ifis) == 0 {
+		return nil, &NoInterfaceError{Group: group, Candidates: candidates}
+	}
+
+	cfg.multi = true
+	if group.To4() != nil {
+		return newIPv4Conn(ifis, group, port, cfg)
+	}
+	return newIPv6Conn(ifis, group, port, cfg)
+}
+
+// link is an interface a connection has joined its groups on
+type link struct {
+	ifi  *net.Interface
+	nets []*net.IPNet
+
+	// cm and oob are the control message sending on the interface, cached so writes don't
+	// allocate
+	cm  interface{}
+	oob []byte
+}
+
+// newLink looks up the addresses of the interface
+func newLink(ifi *net.Interface) link {
+	l := link{ifi: ifi}
+	addrs, _ := ifi.Addrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			l.nets = append(l.nets, n)
+		}
+	}
+	return l
+}
+
+// controlFunc builds the control message for sending on an interface
+type controlFunc func(ifi *net.Interface) (cm interface{}, oob []byte)
+
+// groupFunc joins or leaves a group on an interface
+type groupFunc func(ifi *net.Interface, group net.Addr) error
+
+// membership tracks the interfaces and groups of a connection
+type membership struct {
+	group *net.UDPAddr
+
+	// links change under both locks, so holding either is enough to read them
+	linksMu sync.RWMutex
+	links   []link
+
+	mu     sync.Mutex
+	groups []net.IP
+
+	// control builds the control messages of new links
+	control controlFunc
+
+	// filters select the interfaces joined by JoinInterfaces, when multi is set
+	filters []InterfaceFilter
+	multi   bool
+
+	// ssm is the allowed sources of a source specific connection's group
+	ssm *sourceSet
+}
+
+// newConnMembership joins the group as configured, for the allowed sources only when the
+// connection is source specific
+func newConnMembership(ifis []*net.Interface, group *net.UDPAddr, cfg *connConfig, join groupFunc, joinSource, leaveSource sourceFunc) (*membership, error) {
+	if !cfg.ssm {
+		m, err := newMembership(ifis, group, join)
+		if err != nil {
+			return nil, err
+		}
+		m.filters, m.multi = cfg.filters, cfg.multi
+		return m, nil
+	}
+
+	ssm, err := newSourceSet(group.IP, cfg.sources, joinSource, leaveSource)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMembership(ifis, group, ssm.joinAll)
+	if err != nil {
+		return nil, err
+	}
+	m.ssm, m.filters, m.multi = ssm, cfg.filters, cfg.multi
+	return m, nil
+}
+
+// newMembership joins the group on each interface, dropping interfaces that fail to join
+func newMembership(ifis []*net.Interface, group *net.UDPAddr, join groupFunc) (*membership, error) {
+	m := &membership{group: group, groups: []net.IP{group.IP}}
+
+	var errs []string
+	for _, ifi := range ifis {
+		if err := join(ifi, &net.UDPAddr{IP: group.IP}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", ifi.Name, err))
+			continue
+		}
+
+		m.links = append(m.links, newLink(ifi))
+	}
+
+	if len(m.links) == 0 {
+		return nil, fmt.Errorf("failed to join group (%s): %v", group.IP, errs)
+	}
+	return m, nil
+}
+
+// Group returns the group the connection was created for
+func (m *membership) Group() net.Addr {
+	return m.group
+}
+
+// setControl builds the control messages of every link
+func (m *membership) setControl(control controlFunc) {
+	m.linksMu.Lock()
+	defer m.linksMu.Unlock()
+
+	m.control = control
+	for i := range m.links {
+		m.links[i].cm, m.links[i].oob = control(m.links[i].ifi)
+	}
+}
+
+// setLinks replaces the links, called with mu held
+func (m *membership) setLinks(links []link) {
+	for i := range links {
+		if links[i].cm == nil && m.control != nil {
+			links[i].cm, links[i].oob = m.control(links[i].ifi)
+		}
+	}
+
+	m.linksMu.Lock()
+	m.links = links
+	m.linksMu.Unlock()
+}
+
+// Interfaces returns the interfaces the connection has joined its groups on
+func (m *membership) Interfaces() []*net.Interface {
+	m.linksMu.RLock()
+	defer m.linksMu.RUnlock()
+
+	ifis := make([]*net.Interface, len(m.links))
+	for i, l := range m.links {
+		ifis[i] = l.ifi
+	}
+	return ifis
+}
+
+func (m *membership) join(group net.IP, join groupFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range m.groups {
+		if g.Equal(group) {
+			return nil
+		}
+	}
+
+	var errs []string
+	for _, l := range m.links {
+		if err := join(l.ifi, &net.UDPAddr{IP: group}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", l.ifi.Name, err))
+		}
+	}
+
+	if len(errs) == len(m.links) {
+		return fmt.Errorf("failed to join group (%s): %v", group, errs)
+	}
+
+	m.groups = append(m.groups, group)
+	return nil
+}
+
+func (m *membership) leave(group net.IP, leave groupFunc) error {
+	if group.Equal(m.group.IP) {
+		return errors.New("cannot leave the connection's own group")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, g := range m.groups {
+		if g.Equal(group) {
+			m.groups = append(m.groups[:i], m.groups[i+1:]...)
+			return m.leaveLinks(group, leave)
+		}
+	}
+	return fmt.Errorf("group %s not joined", group)
+}
+
+// rejoin looks the interfaces up again by name, since a replaced interface has a new index,
+// then joins every group again on each interface still present
+func (m *membership) rejoin(join, leave groupFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	links := make([]link, len(m.links))
+	var errs []string
+	for i, l := range m.links {
+		links[i] = l
+
+		ifi, err := net.InterfaceByName(l.ifi.Name)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", l.ifi.Name, err))
+			continue
+		}
+		if ifi.Index != l.ifi.Index || len(l.nets) == 0 {
+			links[i] = newLink(ifi)
+		} else {
+			links[i].ifi = ifi
+			links[i].nets = newLink(ifi).nets
+		}
+
+		for _, g := range m.groups {
+			// Leaving first clears any stale membership, joining twice fails
+			m.leaveFunc(g, leave)(ifi, &net.UDPAddr{IP: g})
+			if err := m.joinFunc(g, join)(ifi, &net.UDPAddr{IP: g}); err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s: %v", ifi.Name, g, err))
+			}
+		}
+	}
+	m.setLinks(links)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to rejoin groups: %v", errs)
+	}
+	return nil
+}
+
+// joinInterfaces joins every group on eligible interfaces passing the filters which aren't
+// links yet
+func (m *membership) joinInterfaces(join groupFunc) ([]*net.Interface, error) {
+	if !m.multi {
+		return nil, nil
+	}
+
+	candidates, err := RankInterfaces(m.group.IP, m.filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	links := append([]link(nil), m.links...)
+	var added []*net.Interface
+	var errs []string
+	for i := range candidates {
+		c := candidates[i]
+		if !c.Eligible() || m.hasLink(c.Interface.Name) {
+			continue
+		}
+
+		ifi := &c.Interface
+		joined := false
+		for _, g := range m.groups {
+			if err := m.joinFunc(g, join)(ifi, &net.UDPAddr{IP: g}); err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s: %v", ifi.Name, g, err))
+				continue
+			}
+			joined = true
+		}
+
+		if joined {
+			links = append(links, newLink(ifi))
+			added = append(added, ifi)
+		}
+	}
+
+	if len(added) > 0 {
+		m.setLinks(links)
+	}
+	if len(errs) > 0 {
+		return added, fmt.Errorf("failed to join interfaces: %v", errs)
+	}
+	return added, nil
+}
+
+func (m *membership) hasLink(name string) bool {
+	for _, l := range m.links {
+		if l.ifi.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *membership) leaveAll(leave groupFunc) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range m.groups {
+		if lerr := m.leaveLinks(g, m.leaveFunc(g, leave)); err == nil {
+			err = lerr
+		}
+	}
+	m.groups = nil
+	return err
+}
+
+func (m *membership) leaveLinks(group net.IP, leave groupFunc) (err error) {
+	for _, l := range m.links {
+		if lerr := leave(l.ifi, &net.UDPAddr{IP: group}); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// joinFunc returns how to join the group, for the allowed sources when it is the group of a
+// source specific connection
+func (m *membership) joinFunc(group net.IP, join groupFunc) groupFunc {
+	if m.ssm != nil && group.Equal(m.group.IP) {
+		return m.ssm.joinAll
+	}
+	return join
+}
+
+// leaveFunc returns how to leave the group, see joinFunc
+func (m *membership) leaveFunc(group net.IP, leave groupFunc) groupFunc {
+	if m.ssm != nil && group.Equal(m.group.IP) {
+		return m.ssm.leaveAll
+	}
+	return leave
+}
+
+func (m *membership) addSource(src net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ssm == nil {
+		return ErrNotSourceSpecific
+	}
+	if m.ssm.allowed(src) {
+		return nil
+	}
+
+	var errs []string
+	for _, l := range m.links {
+		if err := m.ssm.join(l.ifi, &net.UDPAddr{IP: m.group.IP}, &net.UDPAddr{IP: src}); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", l.ifi.Name, err))
+		}
+	}
+
+	if len(errs) == len(m.links) {
+		return fmt.Errorf("failed to allow source (%s): %v", src, errs)
+	}
+
+	m.ssm.sources = append(m.ssm.sources, src)
+	return nil
+}
+
+func (m *membership) removeSource(src net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ssm == nil {
+		return ErrNotSourceSpecific
+	}
+
+	for i, allowed := range m.ssm.sources {
+		if allowed.Equal(src) {
+			m.ssm.sources = append(m.ssm.sources[:i], m.ssm.sources[i+1:]...)
+
+			var err error
+			for _, l := range m.links {
+				if lerr := m.ssm.leave(l.ifi, &net.UDPAddr{IP: m.group.IP}, &net.UDPAddr{IP: src}); err == nil {
+					err = lerr
+				}
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("source %s not allowed", src)
+}
+
+// Sources returns the allowed sources of a source specific connection
+func (m *membership) Sources() []net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ssm == nil {
+		return nil
+	}
+	return append([]net.IP(nil), m.ssm.sources...)
+}
+
+// mtu returns the smallest link mtu of the connection
+func (m *membership) mtu() int {
+	m.linksMu.RLock()
+	defer m.linksMu.RUnlock()
+
+	mtu := 0
+	for _, l := range m.links {
+		if n := linkMTU(l.ifi); mtu == 0 || n < mtu {
+			mtu = n
+		}
+	}
+	return mtu
+}
+
+// routeLink returns the link to send to dst on, see route
+func (m *membership) routeLink(dst net.Addr) link {
+	m.linksMu.RLock()
+	defer m.linksMu.RUnlock()
+	return m.links[m.route(dst)]
+}
+
+// route picks the link to send to dst on. Link local zones are honoured, unicast prefix
+// based groups go out of the interface owning the prefix, and anything else prefers an
+// interface with a global address of the same family.
+func (m *membership) route(dst net.Addr) int {
+	if len(m.links) == 1 {
+		return 0
+	}
+
+	addr, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+
+	if addr.Zone != "" {
+		for i, l := range m.links {
+			if l.ifi.Name == addr.Zone {
+				return i
+			}
+		}
+	}
+
+	ip := addr.IP
+	if prefix := unicastPrefix(ip); prefix != nil {
+		ip = prefix.IP
+	}
+
+	for i, l := range m.links {
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return i
+			}
+		}
+	}
+
+	for i, l := range m.links {
+		for _, n := range l.nets {
+			if n.IP.IsGlobalUnicast() && (n.IP.To4() != nil) == (ip.To4() != nil) {
+				return i
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,86 @@
+package mp2p
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiConnJoinGroup(t *testing.T) {
+	multicastIfi(t)
+
+	c, err := NewMultiConn(net.ParseIP("224.0.250.3"), 20002, WithLoopback(true))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+
+	if len(c.Interfaces()) == 0 {
+		t.Fatal("expected joined interfaces")
+	}
+
+	// Every eligible interface is already joined, and rejoining looks them up again by name
+	if joined, err := c.JoinInterfaces(); err != nil || len(joined) != 0 {
+		t.Errorf("expected no new interfaces, got %v: %v", joined, err)
+	}
+	if err := c.Rejoin(); err != nil {
+		t.Fatal(err)
+	}
+
+	extra := net.ParseIP("224.0.250.4")
+	if err := c.JoinGroup(extra); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.WriteTo([]byte("hello"), &net.UDPAddr{IP: extra, Port: 20002}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetDeadline(time.Now().Add(time.Second))
+	_, info, err := c.ReadMsg(make([]byte, c.MTU()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Dst != nil && !info.Dst.Equal(extra) {
+		t.Errorf("expected datagram for %s, got %s", extra, info.Dst)
+	}
+
+	if err := c.LeaveGroup(extra); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LeaveGroup(extra); err == nil {
+		t.Error("expected leaving twice to fail")
+	}
+	if err := c.LeaveGroup(net.ParseIP("224.0.250.3")); err == nil {
+		t.Error("expected leaving the connection's group to fail")
+	}
+}
+
+func TestMembershipRoute(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.10/24")
+	_, global6, _ := net.ParseCIDR("2001:db8:1:2::10/64")
+	_, local6, _ := net.ParseCIDR("fe80::1/64")
+
+	m := &membership{links: []link{
+		{ifi: &net.Interface{Index: 1, Name: "lo"}},
+		{ifi: &net.Interface{Index: 2, Name: "eth0"}, nets: []*net.IPNet{lan, local6}},
+		{ifi: &net.Interface{Index: 3, Name: "eth1"}, nets: []*net.IPNet{global6}},
+	}}
+
+	tests := []struct {
+		dst  *net.UDPAddr
+		link int
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("ff12::1"), Zone: "eth0"}, 1},
+		{&net.UDPAddr{IP: net.ParseIP("ff3e:40:2001:db8:1:2:1:1")}, 2},
+		{&net.UDPAddr{IP: net.ParseIP("ff1e::1")}, 2},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.20")}, 1},
+		{&net.UDPAddr{IP: net.ParseIP("224.0.250.1")}, 1},
+	}
+
+	for _, test := range tests {
+		if link := m.route(test.dst); link != test.link {
+			t.Errorf("expected %s on link %d, got %d", test.dst, test.link, link)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package mp2p
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultPollInterval is how often a NetWatcher rescans the interfaces when not told to
+const defaultPollInterval = 10 * time.Second
+
+// netSettle is how long a NetWatcher waits after a change notification before rescanning,
+// changes tend to come in bursts
+const netSettle = 100 * time.Millisecond
+
+// NetEventKind is the kind of change a NetWatcher saw
+type NetEventKind int
+
+const (
+	InterfaceUp NetEventKind = iota
+	InterfaceDown
+	AddressAdded
+	AddressRemoved
+)
+
+func (k NetEventKind) String() string {
+	switch k {
+	case InterfaceUp:
+		return "interface up"
+	case InterfaceDown:
+		return "interface down"
+	case AddressAdded:
+		return "address added"
+	case AddressRemoved:
+		return "address removed"
+	}
+	return "unknown"
+}
+
+// NetEvent is a change to a network interface
+type NetEvent struct {
+	Kind      NetEventKind
+	Interface net.Interface
+
+	// Addr is the address added or removed by address events
+	Addr *net.IPNet
+
+	// Addrs are the addresses of the interface after the change
+	Addrs []*net.IPNet
+}
+
+// NetWatcher reports interface changes, using netlink notifications where available and
+// polling the interfaces otherwise
+type NetWatcher struct {
+	interval time.Duration
+	wake     <-chan struct{}
+	last     map[int]ifiState
+
+	mu   sync.Mutex
+	subs []chan NetEvent
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// ifiState is a snapshot of an interface
+type ifiState struct {
+	ifi   net.Interface
+	addrs []*net.IPNet
+}
+
+// NewNetWatcher starts watching the network interfaces, rescanning them at least every
+// interval, or every 10 seconds if it is zero
+func NewNetWatcher(interval time.Duration) (*NetWatcher, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	last, err := scanInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &NetWatcher{interval: interval, last: last, done: make(chan struct{})}
+
+	// Without notifications the watcher falls back to polling
+	w.wake, _ = watchNetlink(w.done)
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Subscribe returns a channel receiving every change from now on, it is closed when the
+// watcher is. Events are dropped for subscribers that fall too far behind.
+func (w *NetWatcher) Subscribe() <-chan NetEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ch := make(chan NetEvent, 32)
+	select {
+	case <-w.done:
+		close(ch)
+	default:
+		w.subs = append(w.subs, ch)
+	}
+	return ch
+}
+
+// Close stops the watcher and closes the subscribed channels
+func (w *NetWatcher) Close() error {
+	w.once.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, ch := range w.subs {
+			close(ch)
+		}
+		w.subs = nil
+	})
+	return nil
+}
+
+func (w *NetWatcher) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.wake:
+			select {
+			case <-w.done:
+				return
+			case <-time.After(netSettle):
+			}
+		}
+
+		next, err := scanInterfaces()
+		if err != nil {
+			continue
+		}
+
+		events := diffInterfaces(w.last, next)
+		w.last = next
+
+		w.mu.Lock()
+		for _, ev := range events {
+			for _, ch := range w.subs {
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// scanInterfaces snapshots the interfaces by index
+func scanInterfaces() (map[int]ifiState, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[int]ifiState, len(ifis))
+	for _, ifi := range ifis {
+		s := ifiState{ifi: ifi}
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				s.addrs = append(s.addrs, n)
+			}
+		}
+		states[ifi.Index] = s
+	}
+	return states, nil
+}
+
+// diffInterfaces lists the changes between two snapshots, ordered by interface index
+func diffInterfaces(prev, next map[int]ifiState) []NetEvent {
+	indexes := make([]int, 0, len(prev)+len(next))
+	for i := range next {
+		indexes = append(indexes, i)
+	}
+	for i := range prev {
+		if _, ok := next[i]; !ok {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	var events []NetEvent
+	for _, i := range indexes {
+		old, hadOld := prev[i]
+		cur, hasCur := next[i]
+
+		if !hasCur {
+			if old.ifi.Flags&net.FlagUp != 0 {
+				events = append(events, NetEvent{Kind: InterfaceDown, Interface: old.ifi})
+			}
+			continue
+		}
+
+		wasUp := hadOld && old.ifi.Flags&net.FlagUp != 0
+		isUp := cur.ifi.Flags&net.FlagUp != 0
+		switch {
+		case isUp && !wasUp:
+			events = append(events, NetEvent{Kind: InterfaceUp, Interface: cur.ifi, Addrs: cur.addrs})
+		case wasUp && !isUp:
+			events = append(events, NetEvent{Kind: InterfaceDown, Interface: cur.ifi, Addrs: cur.addrs})
+		}
+
+		for _, n := range cur.addrs {
+			if !containsNet(old.addrs, n) {
+				events = append(events, NetEvent{Kind: AddressAdded, Interface: cur.ifi, Addr: n, Addrs: cur.addrs})
+			}
+		}
+		for _, n := range old.addrs {
+			if !containsNet(cur.addrs, n) {
+				events = append(events, NetEvent{Kind: AddressRemoved, Interface: cur.ifi, Addr: n, Addrs: cur.addrs})
+			}
+		}
+	}
+	return events
+}
+
+func containsNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, m := range nets {
+		if m.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// MembershipEvent is a network change affecting a connection
+type MembershipEvent struct {
+	NetEvent
+
+	// Group is a newly generated group when the unicast prefix of the connection's group
+	// is no longer on its interface, the node should move to it and declare its address again
+	Group net.IP
+
+	// Joined lists the interfaces the connection joined its groups on, when an interface it
+	// didn't use became eligible
+	Joined []*net.Interface
+
+	// Err is set when rejoining the connection's groups failed
+	Err error
+}
+
+// WatchOption configures WatchMembership
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	generate func(prefix *net.IPNet, scope Scope) net.IP
+}
+
+// WithPrefixGenerator sets how the replacement group is generated when the unicast prefix of
+// the connection's group goes away, such as with NewScopedKeyedIPv6FromPrefix for keyed
+// addresses. By default it is a random group of the same scope (NewScopedIPv6FromPrefix).
+func WithPrefixGenerator(generate func(prefix *net.IPNet, scope Scope) net.IP) WatchOption {
+	return func(c *watchConfig) {
+		c.generate = generate
+	}
+}
+
+// WatchMembership keeps a connection in its groups, rejoining them whenever one of its
+// interfaces comes back up or gains an address, and joining them on other interfaces as they
+// become eligible, until the context is done or the events are closed. Changes to the
+// connection's interfaces are reported on the returned channel.
+func WatchMembership(ctx context.Context, conn MultiConn, events <-chan NetEvent, opts ...WatchOption) <-chan MembershipEvent {
+	out := make(chan MembershipEvent, 16)
+
+	cfg := watchConfig{generate: NewScopedIPv6FromPrefix}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var prefix *net.IPNet
+	var scope Scope
+	if group, ok := conn.Group().(*net.UDPAddr); ok {
+		prefix, scope = unicastPrefix(group.IP), ScopeOf(group.IP)
+	}
+
+	go func() {
+		defer close(out)
+
+		for {
+			var ev NetEvent
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok = <-events:
+				if !ok {
+					return
+				}
+			}
+
+			if !usesInterface(conn, ev.Interface.Name) {
+				if ev.Kind != InterfaceUp && ev.Kind != AddressAdded {
+					continue
+				}
+
+				joined, err := conn.JoinInterfaces()
+				if len(joined) == 0 && err == nil {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- MembershipEvent{NetEvent: ev, Joined: joined, Err: err}:
+				}
+				continue
+			}
+
+			mev := MembershipEvent{NetEvent: ev}
+			if ev.Kind == InterfaceUp || ev.Kind == AddressAdded {
+				mev.Err = conn.Rejoin()
+			}
+
+			if prefix != nil && ev.Kind != InterfaceDown && !ownsPrefix(ev.Addrs, prefix) {
+				for _, n := range ev.Addrs {
+					if group := cfg.generate(n, scope); group != nil {
+						mev.Group, prefix = group, unicastPrefix(group)
+						break
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- mev:
+			}
+		}
+	}()
+
+	return out
+}
+
+func usesInterface(conn MultiConn, name string) bool {
+	for _, ifi := range conn.Interfaces() {
+		if ifi.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ownsPrefix(addrs []*net.IPNet, prefix *net.IPNet) bool {
+	for _, n := range addrs {
+		if prefix.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package mp2p
+
+import "errors"
+
+// watchNetlink is only available on linux, other platforms poll
+func watchNetlink(done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errors.New("interface notifications not supported on this platform")
+}
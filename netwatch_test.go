@@ -0,0 +1,188 @@
+package mp2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiffInterfaces(t *testing.T) {
+	_, a, _ := net.ParseCIDR("2001:db8:1::10/64")
+	_, b, _ := net.ParseCIDR("2001:db8:2::10/64")
+
+	up := net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	down := net.Interface{Index: 2, Name: "eth0", Flags: net.FlagMulticast}
+
+	tests := []struct {
+		prev, next map[int]ifiState
+		kinds      []NetEventKind
+	}{
+		{map[int]ifiState{2: {ifi: down}}, map[int]ifiState{2: {ifi: up}}, []NetEventKind{InterfaceUp}},
+		{map[int]ifiState{2: {ifi: up}}, map[int]ifiState{2: {ifi: down}}, []NetEventKind{InterfaceDown}},
+		{map[int]ifiState{2: {ifi: up}}, map[int]ifiState{}, []NetEventKind{InterfaceDown}},
+		{map[int]ifiState{}, map[int]ifiState{2: {ifi: up, addrs: []*net.IPNet{a}}}, []NetEventKind{InterfaceUp, AddressAdded}},
+		{
+			map[int]ifiState{2: {ifi: up, addrs: []*net.IPNet{a}}},
+			map[int]ifiState{2: {ifi: up, addrs: []*net.IPNet{b}}},
+			[]NetEventKind{AddressAdded, AddressRemoved},
+		},
+		{map[int]ifiState{2: {ifi: up, addrs: []*net.IPNet{a}}}, map[int]ifiState{2: {ifi: up, addrs: []*net.IPNet{a}}}, nil},
+	}
+
+	for i, test := range tests {
+		events := diffInterfaces(test.prev, test.next)
+		if len(events) != len(test.kinds) {
+			t.Errorf("%d: expected %v, got %v", i, test.kinds, events)
+			continue
+		}
+		for j, ev := range events {
+			if ev.Kind != test.kinds[j] {
+				t.Errorf("%d: expected %s, got %s", i, test.kinds[j], ev.Kind)
+			}
+		}
+	}
+}
+
+// rejoinConn is a MultiConn counting rejoins, joining the interfaces in eligible when asked
+type rejoinConn struct {
+	memConn
+	ifis     []*net.Interface
+	eligible []*net.Interface
+	rejoins  int
+}
+
+func (c *rejoinConn) JoinGroup(net.IP) error       { return nil }
+func (c *rejoinConn) LeaveGroup(net.IP) error      { return nil }
+func (c *rejoinConn) Interfaces() []*net.Interface { return c.ifis }
+func (c *rejoinConn) Rejoin() error                { c.rejoins++; return nil }
+
+func (c *rejoinConn) JoinInterfaces() ([]*net.Interface, error) {
+	var joined []*net.Interface
+	for _, ifi := range c.eligible {
+		if !usesInterface(c, ifi.Name) {
+			joined = append(joined, ifi)
+		}
+	}
+	if len(joined) > 0 {
+		c.ifis = append(c.ifis, joined...)
+	}
+	return joined, nil
+}
+
+func TestWatchMembership(t *testing.T) {
+	_, old, _ := net.ParseCIDR("2001:db8:1::10/64")
+	_, renumbered, _ := net.ParseCIDR("2001:db8:2::10/64")
+
+	eth0 := net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	group := NewScopedIPv6FromPrefix(old, ScopeSiteLocal)
+	c := &rejoinConn{memConn: memConn{addr: &net.UDPAddr{IP: group, Port: 1024}}, ifis: []*net.Interface{&eth0}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	events := make(chan NetEvent, 4)
+	out := WatchMembership(ctx, c, events)
+
+	events <- NetEvent{Kind: InterfaceUp, Interface: net.Interface{Index: 3, Name: "eth1"}}
+	events <- NetEvent{Kind: InterfaceUp, Interface: eth0, Addrs: []*net.IPNet{old}}
+	events <- NetEvent{Kind: AddressRemoved, Interface: eth0, Addr: old, Addrs: []*net.IPNet{renumbered}}
+	close(events)
+
+	ev := <-out
+	if ev.Kind != InterfaceUp || ev.Group != nil || c.rejoins != 1 {
+		t.Errorf("expected a rejoin for eth0 coming up, got %+v after %d rejoins", ev, c.rejoins)
+	}
+
+	ev = <-out
+	if ev.Kind != AddressRemoved || ev.Group == nil {
+		t.Fatalf("expected a new group after renumbering, got %+v", ev)
+	}
+	if !unicastPrefix(ev.Group).Contains(renumbered.IP) {
+		t.Errorf("expected group %s in prefix %s", ev.Group, renumbered)
+	}
+	if ScopeOf(ev.Group) != ScopeSiteLocal {
+		t.Errorf("expected the new group to keep the site local scope, got %s", ev.Group)
+	}
+
+	if _, ok := <-out; ok {
+		t.Error("expected events to end")
+	}
+}
+
+func TestWatchMembershipPrefixGenerator(t *testing.T) {
+	_, old, _ := net.ParseCIDR("2001:db8:1::10/64")
+	_, renumbered, _ := net.ParseCIDR("2001:db8:2::10/64")
+	pub := testKey(1).Public().(ed25519.PublicKey)
+
+	eth0 := net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	group := NewKeyedIPv6FromPrefix(pub, old, 0)
+	c := &rejoinConn{memConn: memConn{addr: &net.UDPAddr{IP: group, Port: 1024}}, ifis: []*net.Interface{&eth0}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	events := make(chan NetEvent, 1)
+	out := WatchMembership(ctx, c, events, WithPrefixGenerator(func(prefix *net.IPNet, scope Scope) net.IP {
+		return NewScopedKeyedIPv6FromPrefix(pub, prefix, scope, 0)
+	}))
+
+	events <- NetEvent{Kind: AddressRemoved, Interface: eth0, Addr: old, Addrs: []*net.IPNet{renumbered}}
+	close(events)
+
+	ev := <-out
+	if want := NewKeyedIPv6FromPrefix(pub, renumbered, 0); !ev.Group.Equal(want) {
+		t.Errorf("expected the keyed group %s, got %s", want, ev.Group)
+	}
+}
+
+func TestWatchMembershipJoinsInterfaces(t *testing.T) {
+	eth0 := net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast}
+	eth1 := net.Interface{Index: 3, Name: "eth1", Flags: net.FlagUp | net.FlagMulticast}
+	c := &rejoinConn{
+		memConn:  memConn{addr: &net.UDPAddr{IP: net.ParseIP("ff1e::1234"), Port: 1024}},
+		ifis:     []*net.Interface{&eth0},
+		eligible: []*net.Interface{&eth1},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	events := make(chan NetEvent, 4)
+	out := WatchMembership(ctx, c, events)
+
+	events <- NetEvent{Kind: InterfaceDown, Interface: eth1}
+	events <- NetEvent{Kind: InterfaceUp, Interface: eth1}
+	events <- NetEvent{Kind: AddressAdded, Interface: net.Interface{Index: 4, Name: "eth2"}}
+	close(events)
+
+	ev := <-out
+	if ev.Kind != InterfaceUp || len(ev.Joined) != 1 || ev.Joined[0].Name != "eth1" || c.rejoins != 0 {
+		t.Errorf("expected eth1 to be joined, got %+v after %d rejoins", ev, c.rejoins)
+	}
+	if !usesInterface(c, "eth1") {
+		t.Error("expected the connection to use eth1")
+	}
+
+	if ev, ok := <-out; ok {
+		t.Errorf("expected events to end, got %+v", ev)
+	}
+}
+
+func TestNetWatcher(t *testing.T) {
+	w, err := NewNetWatcher(time.Millisecond)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	events := w.Subscribe()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	for range events {
+	}
+	if _, ok := <-w.Subscribe(); ok {
+		t.Error("expected subscriptions to a closed watcher to be closed")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !race
+// +build !race
+
+package mp2p
+
+const raceEnabled = false
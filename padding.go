@@ -0,0 +1,72 @@
+package mp2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// padTrailerLen is the length of the padding size appended to padded frames
+const padTrailerLen = 2
+
+// PaddingPolicy returns the datagram size a session frame of the given size should be padded
+// to, given the session's path mtu. Returning size or less leaves the frame unpadded.
+type PaddingPolicy func(size, pmtu int) int
+
+// PadToBuckets pads frames up to the smallest bucket size they fit in, and frames larger than
+// every bucket up to the path mtu
+func PadToBuckets(sizes ...int) PaddingPolicy {
+	buckets := append([]int(nil), sizes...)
+	sort.Ints(buckets)
+
+	return func(size, pmtu int) int {
+		for _, b := range buckets {
+			if size <= b {
+				return b
+			}
+		}
+		return pmtu
+	}
+}
+
+// PadToMTU pads every frame to the session's path mtu, hiding all length information at the
+// cost of bandwidth
+func PadToMTU() PaddingPolicy {
+	return func(size, pmtu int) int {
+		return pmtu
+	}
+}
+
+// PadRandom adds up to max bytes of uniformly random padding to every frame
+func PadRandom(max int) PaddingPolicy {
+	return func(size, pmtu int) int {
+		var b [4]byte
+		if max <= 0 {
+			return size
+		}
+		if _, err := rand.Read(b[:]); err != nil {
+			return size
+		}
+		return size + int(binary.BigEndian.Uint32(b[:])%uint32(max+1))
+	}
+}
+
+// unpad strips the padding from a decrypted session frame
+func unpad(plain []byte) ([]byte, error) {
+	if plain[0]&flagPadded == 0 {
+		return plain, nil
+	}
+
+	if len(plain) < frameHeaderLen+padTrailerLen {
+		return nil, errors.New("short padded session frame")
+	}
+
+	n := len(plain) - padTrailerLen
+	pad := int(binary.BigEndian.Uint16(plain[n:]))
+	if pad > n-frameHeaderLen {
+		return nil, errors.New("invalid session frame padding")
+	}
+
+	return plain[:n-pad], nil
+}
@@ -0,0 +1,56 @@
+package mp2p
+
+import (
+	"testing"
+)
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		policy PaddingPolicy
+		data   int
+		size   int
+	}{
+		{PadToBuckets(256, 512), 5, 256},
+		{PadToBuckets(256, 512), 300, 512},
+		{PadToBuckets(256, 512), 600, 1200},
+		{PadToMTU(), 0, 1200},
+		{PadRandom(0), 10, sessionOverhead + padTrailerLen + 10},
+	}
+
+	for _, test := range tests {
+		a, b := newMemConnPair(1452, 1452)
+		sa, sb := newSessionPair(t, a, b, WithPadding(test.policy))
+
+		data := make([]byte, test.data)
+		if _, err := sa.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		p := <-b.reads
+		if len(p.data) != test.size {
+			t.Errorf("expected datagram size %d, got %d", test.size, len(p.data))
+		}
+
+		payload, err := ParseSessionDataPayload(p.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := sb.Handle(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != test.data {
+			t.Errorf("expected %d bytes after unpadding, got %d", test.data, len(got))
+		}
+	}
+}
+
+func TestPadRandom(t *testing.T) {
+	pad := PadRandom(16)
+	for i := 0; i < 100; i++ {
+		if n := pad(100, 1200); n < 100 || n > 116 {
+			t.Fatalf("random padding out of range: %d", n)
+		}
+	}
+}
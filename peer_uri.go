@@ -0,0 +1,178 @@
+package mp2p
+
+import (
+	"crypto/ed25519"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PeerURIScheme is the scheme of peer uris
+	PeerURIScheme = "mp2p"
+
+	// compactPrefix starts compact peer uris, in the qr code alphanumeric character set
+	compactPrefix = "MP2P:"
+)
+
+// peerEncoding encodes keys in peer uris, uppercased for compact uris
+var peerEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// PeerURI is everything needed to reach a peer: its key, its group and port, and any
+// alternative groups such as an ipv4 group for peers without ipv6 multicast
+type PeerURI struct {
+	Key  ed25519.PublicKey
+	Addr *net.UDPAddr
+	Alt  []*net.UDPAddr
+}
+
+// ParsePeerURI parses a peer uri, either as returned by String such as
+// mp2p://<base32 key>@[ff1e::1]:1024?alt=224.0.247.161:1024 or as returned by Compact
+func ParsePeerURI(s string) (PeerURI, error) {
+	if strings.HasPrefix(strings.ToUpper(s), compactPrefix) && !strings.HasPrefix(s[len(compactPrefix):], "//") {
+		return parseCompactPeerURI(s[len(compactPrefix):])
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return PeerURI{}, err
+	}
+	if u.Scheme != PeerURIScheme {
+		return PeerURI{}, fmt.Errorf("invalid peer uri scheme %q", u.Scheme)
+	}
+	if u.User == nil {
+		return PeerURI{}, errors.New("peer uri has no key")
+	}
+
+	var p PeerURI
+	if p.Key, err = parsePeerKey(u.User.Username()); err != nil {
+		return PeerURI{}, err
+	}
+	if p.Addr, err = parsePeerAddr(u.Host); err != nil {
+		return PeerURI{}, err
+	}
+
+	for _, alt := range u.Query()["alt"] {
+		addr, err := parsePeerAddr(alt)
+		if err != nil {
+			return PeerURI{}, err
+		}
+		p.Alt = append(p.Alt, addr)
+	}
+	return p, nil
+}
+
+// String returns the peer uri
+func (p PeerURI) String() string {
+	u := url.URL{
+		Scheme: PeerURIScheme,
+		User:   url.User(strings.ToLower(peerEncoding.EncodeToString(p.Key))),
+		Host:   p.Addr.String(),
+	}
+
+	// Addresses are left unescaped to keep the uri readable
+	alts := make([]string, len(p.Alt))
+	for i, alt := range p.Alt {
+		alts[i] = "alt=" + alt.String()
+	}
+	u.RawQuery = strings.Join(alts, "&")
+	return u.String()
+}
+
+// Addrs returns the group and alternative groups of the peer
+func (p PeerURI) Addrs() []*net.UDPAddr {
+	return append([]*net.UDPAddr{p.Addr}, p.Alt...)
+}
+
+// Compact returns the peer uri encoded in binary, as uppercase base32 so qr codes can use
+// their denser alphanumeric mode
+func (p PeerURI) Compact() string {
+	b := append([]byte(nil), p.Key...)
+	for _, addr := range p.Addrs() {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			b = append(b, net.IPv4len)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, net.IPv6len)
+			b = append(b, addr.IP.To16()...)
+		}
+		b = append(b, byte(addr.Port>>8), byte(addr.Port))
+	}
+	return compactPrefix + peerEncoding.EncodeToString(b)
+}
+
+func parseCompactPeerURI(s string) (PeerURI, error) {
+	b, err := peerEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return PeerURI{}, fmt.Errorf("invalid compact peer uri: %w", err)
+	}
+	if len(b) < ed25519.PublicKeySize {
+		return PeerURI{}, errors.New("compact peer uri has no key")
+	}
+
+	p := PeerURI{Key: ed25519.PublicKey(b[:ed25519.PublicKeySize])}
+	b = b[ed25519.PublicKeySize:]
+
+	for len(b) > 0 {
+		iplen := int(b[0])
+		if (iplen != net.IPv4len && iplen != net.IPv6len) || len(b) < 1+iplen+2 {
+			return PeerURI{}, errors.New("invalid compact peer uri address")
+		}
+
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), b[1:1+iplen]...),
+			Port: int(b[1+iplen])<<8 | int(b[2+iplen]),
+		}
+		if g := ClassifyGroup(addr.IP); !g.Valid {
+			return PeerURI{}, fmt.Errorf("invalid group %s: %s", addr.IP, g.Reason)
+		}
+
+		if p.Addr == nil {
+			p.Addr = addr
+		} else {
+			p.Alt = append(p.Alt, addr)
+		}
+		b = b[1+iplen+2:]
+	}
+
+	if p.Addr == nil {
+		return PeerURI{}, errors.New("compact peer uri has no address")
+	}
+	return p, nil
+}
+
+func parsePeerKey(s string) (ed25519.PublicKey, error) {
+	key, err := peerEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid peer key %q", s)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func parsePeerAddr(s string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Link local groups may name their interface
+	var zone string
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+
+	g, err := ParseGroup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.UDPAddr{IP: g.IP, Port: int(n), Zone: zone}, nil
+}
@@ -0,0 +1,51 @@
+package mp2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPeerURI(t *testing.T) {
+	p := PeerURI{
+		Key:  testKey(1).Public().(ed25519.PublicKey),
+		Addr: &net.UDPAddr{IP: net.ParseIP("ff1e::1234"), Port: 1024},
+		Alt:  []*net.UDPAddr{{IP: net.ParseIP("224.0.247.161").To4(), Port: 1025}},
+	}
+
+	s := p.String()
+	if !strings.HasPrefix(s, "mp2p://") || !strings.Contains(s, "@[ff1e::1234]:1024?alt=224.0.247.161:1025") {
+		t.Errorf("unexpected peer uri %s", s)
+	}
+
+	for _, s := range []string{s, p.Compact(), strings.ToLower(p.Compact())} {
+		got, err := ParsePeerURI(s)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", s, err)
+		}
+		if !bytes.Equal(got.Key, p.Key) || got.Addr.String() != p.Addr.String() || len(got.Alt) != 1 || got.Alt[0].String() != p.Alt[0].String() {
+			t.Errorf("expected %s, got %s", p, got)
+		}
+	}
+
+	if len(p.Compact()) >= len(s) {
+		t.Errorf("expected the compact uri to be shorter than %d, got %d", len(s), len(p.Compact()))
+	}
+
+	key := strings.ToLower(peerEncoding.EncodeToString(p.Key))
+	for _, s := range []string{
+		"http://" + key + "@[ff1e::1]:1024",
+		"mp2p://[ff1e::1]:1024",
+		"mp2p://abc@[ff1e::1]:1024",
+		"mp2p://" + key + "@[ff02::1]:1024",
+		"mp2p://" + key + "@[ff1e::1]:70000",
+		"mp2p://" + key + "@[ff1e::1]:1024?alt=224.0.250.1:1024",
+		"MP2P:AAAA",
+	} {
+		if _, err := ParsePeerURI(s); err == nil {
+			t.Errorf("expected %s to fail", s)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package mp2p
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -11,104 +10,203 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
+// BatchMessage is a single datagram of a batch read or write, it is the same type as both
+// ipv4.Message and ipv6.Message
+type BatchMessage = ipv4.Message
+
+// PacketInfo describes how a datagram arrived, fields the platform doesn't report are zero
+type PacketInfo struct {
+	// Src is the address the datagram was sent from
+	Src net.Addr
+
+	// Dst is the destination address, the group for multicast datagrams
+	Dst net.IP
+
+	// IfIndex is the index of the interface the datagram arrived on
+	IfIndex int
+
+	// HopLimit is the remaining ipv6 hop limit or ipv4 ttl
+	HopLimit int
+}
+
 // PacketConn is the shared interface of an ipv4 or ipv6 packet connection
 type PacketConn interface {
 	WriteTo(b []byte, dst net.Addr) (n int, err error)
 	ReadFrom(b []byte) (n int, src net.Addr, err error)
+	ReadMsg(b []byte) (n int, info PacketInfo, err error)
+	WriteBatch(ms []BatchMessage, flags int) (int, error)
+	ReadBatch(ms []BatchMessage, flags int) (int, error)
 	SetDeadline(time.Time) error
 	Close() error
 	Group() net.Addr
+	MTU() int
 }
 
-// NewConn creates a new ipv4 or ipv6 packet connection
-func NewConn(ifi *net.Interface, group net.IP, port int) (PacketConn, error) {
+const (
+	// defaultLinkMTU is assumed when an interface does not report its mtu
+	defaultLinkMTU = 1500
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+)
+
+// NewConn creates a new ipv4 or ipv6 packet connection on the interface, or on the best one
+// selected for the group if it is nil. The connections returned also implement MultiConn.
+func NewConn(ifi *net.Interface, group net.IP, port int, opts ...ConnOption) (PacketConn, error) {
 	if group.To4() != nil {
-		return NewIPv4Conn(ifi, group, port)
+		return NewIPv4Conn(ifi, group, port, opts...)
 	}
 
-	return NewIPv6Conn(ifi, group, port)
+	return NewIPv6Conn(ifi, group, port, opts...)
 }
 
 // NewIPv4Conn creates a new ipv4 packet connection
-func NewIPv4Conn(ifi *net.Interface, group net.IP, port int) (p PacketConn, err error) {
-	if ifi, err = getIfi(ifi); err != nil {
+func NewIPv4Conn(ifi *net.Interface, group net.IP, port int, opts ...ConnOption) (PacketConn, error) {
+	cfg := newConnConfig(opts)
+	ifi, err := getIfi(ifi, group, cfg)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get interface: %w", err)
 	}
 
+	return newIPv4Conn([]*net.Interface{ifi}, group, port, cfg)
+}
+
+func newIPv4Conn(ifis []*net.Interface, group net.IP, port int, cfg *connConfig) (*ipv4Conn, error) {
+	cfg.scope(group)
 	ipGroup := &net.UDPAddr{IP: group, Port: port}
-	c, err := net.ListenPacket("udp4", ":"+strconv.Itoa(port))
+	c, err := cfg.listen("udp4", ":"+strconv.Itoa(port))
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen: %w", err)
 	}
 
 	pkt := ipv4.NewPacketConn(c)
-	if err := pkt.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+	m, err := newConnMembership(ifis, ipGroup, cfg, pkt.JoinGroup, pkt.JoinSourceSpecificGroup, pkt.LeaveSourceSpecificGroup)
+	if err != nil {
 		c.Close()
-		return nil, fmt.Errorf("failed to join group (%s): %w", group, err)
+		return nil, err
 	}
 
-	if err := pkt.SetMulticastTTL(255); err != nil {
+	if err := pkt.SetMulticastTTL(cfg.ttl); err != nil {
 		c.Close()
 		return nil, fmt.Errorf("failed to set multicast ttl: %w", err)
 	}
 
-	if err := pkt.SetTTL(255); err != nil {
+	if err := pkt.SetTTL(cfg.ttl); err != nil {
 		c.Close()
 		return nil, fmt.Errorf("failed to set ttl: %w", err)
 	}
 
-	return &ipv4Conn{
-		PacketConn: pkt,
-		ifi:        ifi,
-		group:      ipGroup,
-	}, nil
+	if err := pkt.SetTOS(cfg.trafficClass); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to set tos: %w", err)
+	}
+
+	if cfg.loopback != nil {
+		if err := pkt.SetMulticastLoopback(*cfg.loopback); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to set multicast loopback: %w", err)
+		}
+	}
+
+	// Control messages are best effort, some platforms don't support them
+	pkt.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface|ipv4.FlagTTL, true)
+
+	if err := setDontFragment(c, false); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to set dont fragment: %w", err)
+	}
+
+	m.setControl(func(ifi *net.Interface) (interface{}, []byte) {
+		cm := &ipv4.ControlMessage{IfIndex: ifi.Index, TTL: cfg.ttl}
+		return cm, cm.Marshal()
+	})
+	return &ipv4Conn{PacketConn: pkt, membership: m}, nil
 }
 
 // NewIPv6Conn creates a new ipv6 packet connection
-func NewIPv6Conn(ifi *net.Interface, group net.IP, port int) (p PacketConn, err error) {
-	if ifi, err = getIfi(ifi); err != nil {
+func NewIPv6Conn(ifi *net.Interface, group net.IP, port int, opts ...ConnOption) (PacketConn, error) {
+	cfg := newConnConfig(opts)
+	ifi, err := getIfi(ifi, group, cfg)
+	if err != nil {
 		return nil, err
 	}
 
+	return newIPv6Conn([]*net.Interface{ifi}, group, port, cfg)
+}
+
+func newIPv6Conn(ifis []*net.Interface, group net.IP, port int, cfg *connConfig) (*ipv6Conn, error) {
+	cfg.scope(group)
 	ipGroup := &net.UDPAddr{IP: group, Port: port}
-	c, err := net.ListenPacket("udp6", "[::]:"+strconv.Itoa(port))
+	c, err := cfg.listen("udp6", "[::]:"+strconv.Itoa(port))
 	if err != nil {
 		return nil, err
 	}
 
 	pkt := ipv6.NewPacketConn(c)
-	if err := pkt.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+	m, err := newConnMembership(ifis, ipGroup, cfg, pkt.JoinGroup, pkt.JoinSourceSpecificGroup, pkt.LeaveSourceSpecificGroup)
+	if err != nil {
 		c.Close()
 		return nil, err
 	}
 
-	if err := pkt.SetMulticastHopLimit(255); err != nil {
+	if err := pkt.SetMulticastHopLimit(cfg.hopLimit); err != nil {
 		c.Close()
 		return nil, err
 	}
 
-	if err := pkt.SetHopLimit(255); err != nil {
+	if err := pkt.SetHopLimit(cfg.hopLimit); err != nil {
 		c.Close()
 		return nil, err
 	}
 
-	return &ipv6Conn{
-		PacketConn: pkt,
-		ifi:        ifi,
-		group:      ipGroup,
-	}, nil
+	if err := pkt.SetTrafficClass(cfg.trafficClass); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if cfg.loopback != nil {
+		if err := pkt.SetMulticastLoopback(*cfg.loopback); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	// Control messages are best effort, some platforms don't support them
+	pkt.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface|ipv6.FlagHopLimit, true)
+
+	if err := setDontFragment(c, true); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	m.setControl(func(ifi *net.Interface) (interface{}, []byte) {
+		cm := &ipv6.ControlMessage{TrafficClass: cfg.trafficClass, HopLimit: cfg.hopLimit, IfIndex: ifi.Index}
+		return cm, cm.Marshal()
+	})
+	return &ipv6Conn{PacketConn: pkt, membership: m}, nil
 }
 
 // ipv4Conn is an ipv4 implementation of PacketConn
 type ipv4Conn struct {
 	*ipv4.PacketConn
-	ifi   *net.Interface
-	group *net.UDPAddr
+	*membership
 }
 
+// WriteTo writes b to dst on the interface best matching it
 func (i *ipv4Conn) WriteTo(b []byte, dst net.Addr) (n int, err error) {
-	wcm := &ipv4.ControlMessage{IfIndex: i.ifi.Index, TTL: 255}
-	return i.PacketConn.WriteTo(b, wcm, dst)
+	return i.PacketConn.WriteTo(b, i.routeLink(dst).cm.(*ipv4.ControlMessage), dst)
+}
+
+// WriteBatch writes the messages with as few system calls as the platform allows, messages
+// without control data are sent on the interface best matching their destination
+func (i *ipv4Conn) WriteBatch(ms []BatchMessage, flags int) (int, error) {
+	for j := range ms {
+		if ms[j].OOB == nil {
+			ms[j].OOB = i.routeLink(ms[j].Addr).oob
+		}
+	}
+	return i.PacketConn.WriteBatch(ms, flags)
 }
 
 func (i *ipv4Conn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
@@ -116,59 +214,151 @@ func (i *ipv4Conn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 	return
 }
 
+// ReadMsg reads a datagram along with the group, interface and ttl it arrived with
+func (i *ipv4Conn) ReadMsg(b []byte) (n int, info PacketInfo, err error) {
+	n, cm, src, err := i.PacketConn.ReadFrom(b)
+	info.Src = src
+	if cm != nil {
+		info.Dst, info.IfIndex, info.HopLimit = cm.Dst, cm.IfIndex, cm.TTL
+	}
+	return n, info, err
+}
+
+// JoinGroup joins another group on every interface of the connection
+func (i *ipv4Conn) JoinGroup(group net.IP) error {
+	return i.join(group, i.PacketConn.JoinGroup)
+}
+
+// LeaveGroup leaves a group joined with JoinGroup
+func (i *ipv4Conn) LeaveGroup(group net.IP) error {
+	return i.leave(group, i.PacketConn.LeaveGroup)
+}
+
+// AddSource allows datagrams to the group from the source
+func (i *ipv4Conn) AddSource(src net.IP) error {
+	return i.addSource(src)
+}
+
+// RemoveSource stops receiving datagrams to the group from the source
+func (i *ipv4Conn) RemoveSource(src net.IP) error {
+	return i.removeSource(src)
+}
+
+// Rejoin joins every group again on every interface of the connection
+func (i *ipv4Conn) Rejoin() error {
+	return i.rejoin(i.PacketConn.JoinGroup, i.PacketConn.LeaveGroup)
+}
+
+// JoinInterfaces joins the connection's groups on newly eligible interfaces
+func (i *ipv4Conn) JoinInterfaces() ([]*net.Interface, error) {
+	return i.joinInterfaces(i.PacketConn.JoinGroup)
+}
+
 func (i *ipv4Conn) Close() error {
-	if err := i.LeaveGroup(i.ifi, i.group); err != nil {
+	if err := i.leaveAll(i.PacketConn.LeaveGroup); err != nil {
 		i.PacketConn.Close()
 		return err
 	}
 	return i.PacketConn.Close()
 }
 
-func (i *ipv4Conn) Group() net.Addr {
-	return i.group
+// MTU returns the largest udp payload that fits in a single packet on every interface
+func (i *ipv4Conn) MTU() int {
+	return i.mtu() - ipv4HeaderLen - udpHeaderLen
 }
 
-// ipv4Conn is an IPv6 implementation of PacketConn
+// ipv6Conn is an IPv6 implementation of PacketConn
 type ipv6Conn struct {
 	*ipv6.PacketConn
-	ifi   *net.Interface
-	group *net.UDPAddr
+	*membership
 }
 
+// WriteTo writes b to dst on the interface best matching it
 func (i *ipv6Conn) WriteTo(b []byte, dst net.Addr) (n int, err error) {
-	wcm := &ipv6.ControlMessage{TrafficClass: 0xe0, HopLimit: 255, IfIndex: i.ifi.Index}
-	return i.PacketConn.WriteTo(b, wcm, dst)
+	return i.PacketConn.WriteTo(b, i.routeLink(dst).cm.(*ipv6.ControlMessage), dst)
+}
+
+// WriteBatch writes the messages with as few system calls as the platform allows, messages
+// without control data are sent on the interface best matching their destination
+func (i *ipv6Conn) WriteBatch(ms []BatchMessage, flags int) (int, error) {
+	for j := range ms {
+		if ms[j].OOB == nil {
+			ms[j].OOB = i.routeLink(ms[j].Addr).oob
+		}
+	}
+	return i.PacketConn.WriteBatch(ms, flags)
 }
+
 func (i *ipv6Conn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 	n, _, src, err = i.PacketConn.ReadFrom(b)
 	return
 }
 
+// ReadMsg reads a datagram along with the group, interface and hop limit it arrived with
+func (i *ipv6Conn) ReadMsg(b []byte) (n int, info PacketInfo, err error) {
+	n, cm, src, err := i.PacketConn.ReadFrom(b)
+	info.Src = src
+	if cm != nil {
+		info.Dst, info.IfIndex, info.HopLimit = cm.Dst, cm.IfIndex, cm.HopLimit
+	}
+	return n, info, err
+}
+
+// JoinGroup joins another group on every interface of the connection
+func (i *ipv6Conn) JoinGroup(group net.IP) error {
+	return i.join(group, i.PacketConn.JoinGroup)
+}
+
+// LeaveGroup leaves a group joined with JoinGroup
+func (i *ipv6Conn) LeaveGroup(group net.IP) error {
+	return i.leave(group, i.PacketConn.LeaveGroup)
+}
+
+// AddSource allows datagrams to the group from the source
+func (i *ipv6Conn) AddSource(src net.IP) error {
+	return i.addSource(src)
+}
+
+// RemoveSource stops receiving datagrams to the group from the source
+func (i *ipv6Conn) RemoveSource(src net.IP) error {
+	return i.removeSource(src)
+}
+
+// Rejoin joins every group again on every interface of the connection
+func (i *ipv6Conn) Rejoin() error {
+	return i.rejoin(i.PacketConn.JoinGroup, i.PacketConn.LeaveGroup)
+}
+
+// JoinInterfaces joins the connection's groups on newly eligible interfaces
+func (i *ipv6Conn) JoinInterfaces() ([]*net.Interface, error) {
+	return i.joinInterfaces(i.PacketConn.JoinGroup)
+}
+
 func (i *ipv6Conn) Close() error {
-	if err := i.LeaveGroup(i.ifi, i.group); err != nil {
+	if err := i.leaveAll(i.PacketConn.LeaveGroup); err != nil {
 		i.PacketConn.Close()
 		return err
 	}
 	return i.PacketConn.Close()
 }
 
-func (i *ipv6Conn) Group() net.Addr {
-	return i.group
+// MTU returns the largest udp payload that fits in a single packet on every interface
+func (i *ipv6Conn) MTU() int {
+	return i.mtu() - ipv6HeaderLen - udpHeaderLen
 }
 
-func getIfi(ifi *net.Interface) (*net.Interface, error) {
-	if ifi != nil {
-		return ifi, nil
-	}
-
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return nil, err
+func linkMTU(ifi *net.Interface) int {
+	if ifi == nil || ifi.MTU <= 0 {
+		return defaultLinkMTU
 	}
+	return ifi.MTU
+}
 
-	if len(interfaces) < 1 {
-		return nil, errors.New("no net interfaces found")
+// getIfi returns the given interface, or selects the best one for the group if it is nil
+func getIfi(ifi *net.Interface, group net.IP, cfg *connConfig) (*net.Interface, error) {
+	if ifi != nil {
+		return ifi, nil
 	}
 
-	return &interfaces[0], nil
+	return SelectInterface(group, cfg.filters...)
 }
@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package mp2p
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the DF bit on outgoing packets so that oversized path mtu probes are
+// dropped instead of being fragmented along the path. The probe mode ignores the kernel's
+// cached path mtu, leaving the session layer in charge of datagram sizes.
+func setDontFragment(c net.PacketConn, ipv6 bool) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,154 @@
+package mp2p
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// defaultHopLimit is the ttl or hop limit of globally scoped groups
+const defaultHopLimit = 255
+
+// ScopeHopLimit is passed to WithTTL and WithHopLimit for the default ttl or hop limit, matching
+// the scope of the group
+const ScopeHopLimit = -1
+
+// ConnOption configures optional PacketConn behaviour
+type ConnOption func(*connConfig)
+
+type connConfig struct {
+	ttl          int
+	hopLimit     int
+	trafficClass int
+	loopback     *bool
+	readBuffer   int
+	reusePort    bool
+	filters      []InterfaceFilter
+	ssm          bool
+	sources      []net.IP
+
+	// multi is set for connections joining every eligible interface
+	multi bool
+}
+
+func newConnConfig(opts []ConnOption) *connConfig {
+	c := &connConfig{ttl: ScopeHopLimit, hopLimit: ScopeHopLimit}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithTTL sets the ttl of packets sent by ipv4 connections, by default it matches the scope
+// of the group. A ttl of 0 keeps packets on the host, any negative ttl is ScopeHopLimit.
+func WithTTL(ttl int) ConnOption {
+	return func(c *connConfig) {
+		c.ttl = ttl
+	}
+}
+
+// WithHopLimit sets the hop limit of packets sent by ipv6 connections, by default it matches
+// the scope of the group. A hop limit of 0 keeps packets on the host, any negative hop limit
+// is ScopeHopLimit.
+func WithHopLimit(hops int) ConnOption {
+	return func(c *connConfig) {
+		c.hopLimit = hops
+	}
+}
+
+// WithTrafficClass sets the ipv6 traffic class or ipv4 type of service byte of sent packets
+func WithTrafficClass(tc int) ConnOption {
+	return func(c *connConfig) {
+		c.trafficClass = tc
+	}
+}
+
+// WithDSCP sets the differentiated services code point of sent packets, leaving the ecn bits
+// of the traffic class clear
+func WithDSCP(dscp int) ConnOption {
+	return WithTrafficClass(dscp << 2)
+}
+
+// WithLoopback enables or disables receiving the connection's own multicast packets, by
+// default the operating system decides
+func WithLoopback(on bool) ConnOption {
+	return func(c *connConfig) {
+		c.loopback = &on
+	}
+}
+
+// WithReadBuffer sets the size of the socket receive buffer in bytes
+func WithReadBuffer(bytes int) ConnOption {
+	return func(c *connConfig) {
+		c.readBuffer = bytes
+	}
+}
+
+// WithReusePort lets several sockets on the host listen on the same port, so more than one
+// process can join groups on it
+func WithReusePort(on bool) ConnOption {
+	return func(c *connConfig) {
+		c.reusePort = on
+	}
+}
+
+// WithInterfaceFilter restricts which interfaces are selected for the connection when none
+// is given explicitly
+func WithInterfaceFilter(filters ...InterfaceFilter) ConnOption {
+	return func(c *connConfig) {
+		c.filters = append(c.filters, filters...)
+	}
+}
+
+// WithSourceSpecific joins the connection's group only for the given sources, more can be
+// allowed later through SourceFilter as peers are authenticated. The group must be in the
+// source specific range, 232.0.0.0/8 or ff3x::/32.
+func WithSourceSpecific(sources ...net.IP) ConnOption {
+	return func(c *connConfig) {
+		c.ssm = true
+		c.sources = append(c.sources, sources...)
+	}
+}
+
+// scope defaults the ttl and hop limit to the scope of the group when they aren't configured
+func (c *connConfig) scope(group net.IP) {
+	if c.ttl < 0 {
+		c.ttl = ScopeOf(group).HopLimit()
+	}
+	if c.hopLimit < 0 {
+		c.hopLimit = ScopeOf(group).HopLimit()
+	}
+}
+
+// listen opens the udp socket the connection is built on
+func (c *connConfig) listen(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	if c.reusePort {
+		lc.Control = func(network, address string, raw syscall.RawConn) error {
+			var serr error
+			if err := raw.Control(func(fd uintptr) {
+				serr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.readBuffer > 0 {
+		if udp, ok := conn.(*net.UDPConn); ok {
+			if err := udp.SetReadBuffer(c.readBuffer); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package mp2p
+
+import "net"
+
+// setDontFragment is a no-op on platforms without a portable DF socket option, probes
+// may be fragmented and path mtu discovery will overestimate
+func setDontFragment(c net.PacketConn, ipv6 bool) error {
+	return nil
+}
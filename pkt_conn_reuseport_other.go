@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mp2p
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("reuse port is not supported on this platform")
+}
@@ -2,6 +2,8 @@ package mp2p
 
 import (
 	"net"
+	"testing"
+	"time"
 )
 
 type BuggyConn struct {
@@ -69,3 +71,95 @@ func cp(buf, out []byte) int {
 	copy(out, buf)
 	return len(buf)
 }
+
+// multicastIfi returns an interface multicast tests can run on, skipping the test if none
+func multicastIfi(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			return &ifi
+		}
+	}
+
+	t.Skip("no multicast interface")
+	return nil
+}
+
+func TestReadMsg(t *testing.T) {
+	ifi := multicastIfi(t)
+
+	for _, group := range []net.IP{net.ParseIP("224.0.250.1"), net.ParseIP("ff12::4d50:3250")} {
+		c, err := NewConn(ifi, group, 20000)
+		if err != nil {
+			t.Logf("skipping %s: %v", group, err)
+			continue
+		}
+
+		if _, err := c.WriteTo([]byte("hello"), c.Group()); err != nil {
+			c.Close()
+			t.Logf("skipping %s: %v", group, err)
+			continue
+		}
+
+		c.SetDeadline(time.Now().Add(time.Second))
+		n, info, err := c.ReadMsg(make([]byte, c.MTU()))
+		c.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len("hello") {
+			t.Errorf("expected %d bytes, got %d", len("hello"), n)
+		}
+		if info.Src == nil {
+			t.Error("expected source address")
+		}
+		if info.Dst != nil && !info.Dst.Equal(group) {
+			t.Errorf("expected destination %s, got %s", group, info.Dst)
+		}
+		if info.IfIndex != 0 && info.IfIndex != ifi.Index {
+			t.Errorf("expected interface %d, got %d", ifi.Index, info.IfIndex)
+		}
+	}
+}
+
+func TestConnOptions(t *testing.T) {
+	ifi := multicastIfi(t)
+
+	for _, group := range []net.IP{net.ParseIP("224.0.250.2"), net.ParseIP("ff12::4d50:3251")} {
+		opts := []ConnOption{WithTTL(2), WithHopLimit(2), WithDSCP(10), WithLoopback(true), WithReusePort(true), WithReadBuffer(1 << 16)}
+
+		a, err := NewConn(ifi, group, 20001, opts...)
+		if err != nil {
+			t.Logf("skipping %s: %v", group, err)
+			continue
+		}
+
+		// Reusing the port lets a second socket join the same group
+		b, err := NewConn(ifi, group, 20001, opts...)
+		if err != nil {
+			a.Close()
+			t.Fatal(err)
+		}
+
+		if _, err := a.WriteTo([]byte("hello"), a.Group()); err != nil {
+			t.Fatal(err)
+		}
+
+		b.SetDeadline(time.Now().Add(time.Second))
+		_, info, err := b.ReadMsg(make([]byte, b.MTU()))
+		a.Close()
+		b.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.HopLimit != 0 && info.HopLimit != 2 {
+			t.Errorf("expected hop limit 2, got %d", info.HopLimit)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package mp2p
+
+// raceEnabled is set when testing with the race detector, which makes sync.Pool drop items
+// and so allocate
+const raceEnabled = true
@@ -0,0 +1,555 @@
+package mp2p
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Session frame kinds, carried in the first byte of every decrypted session payload
+const (
+	frameData uint8 = iota
+	frameProbe
+	frameProbeAck
+	frameDummy
+	frameCompression
+)
+
+// Session frame flags, carried in the high bits of the frame kind
+const (
+	frameKindMask  uint8 = 0x0f
+	flagPadded     uint8 = 0x80
+	flagCompressed uint8 = 0x40
+)
+
+const (
+	// BasePLPMTU is the datagram size assumed to reach any peer before path mtu discovery
+	// has confirmed anything larger (RFC 8899)
+	BasePLPMTU = 1200
+
+	frameHeaderLen = 1
+	probeHeaderLen = frameHeaderLen + 4 + 2
+
+	// sessionHeaderLen is the type, session id and nonce preceding the session ciphertext
+	sessionHeaderLen = 1 + 16 + 12
+
+	// sessionOverhead is everything a session adds around application data on the wire
+	sessionOverhead = sessionHeaderLen + gcmTagLen + frameHeaderLen
+
+	gcmTagLen = 16
+)
+
+var (
+	// ErrMessageTooLarge is returned when data does not fit in a single datagram at the
+	// session's current path mtu
+	ErrMessageTooLarge = errors.New("message exceeds session path mtu")
+
+	// ErrWrongSession is returned when a payload for another session is handled
+	ErrWrongSession = errors.New("payload belongs to another session")
+
+	// ErrSessionClosed is returned when writing to a closed session
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// bufferPool reuses datagram sized buffers, so reading and writing session payloads doesn't
+// allocate in steady state
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// newBufferPool creates a pool of buffers of the given size, usually the connection's MTU
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// get returns a buffer from the pool, pointers are pooled so putting it back doesn't allocate
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns a buffer to the pool, nothing may use it afterwards
+func (p *bufferPool) put(b *[]byte) {
+	*b = (*b)[:cap(*b)]
+	p.pool.Put(b)
+}
+
+// Session is an encrypted session with a single peer over a shared PacketConn. Incoming
+// session payloads are read by the owner of the connection and passed to Handle.
+type Session struct {
+	ID   [16]byte
+	conn PacketConn
+	peer net.Addr
+	aead cipher.AEAD
+	bufs *bufferPool
+
+	probeTimeout time.Duration
+	maxProbes    int
+	padding      PaddingPolicy
+	cover        *coverTraffic
+	compression  *compression
+
+	mu     sync.Mutex
+	pmtu   int
+	seq    uint32
+	closed bool
+
+	probing sync.Mutex
+	acks    chan probeAck
+}
+
+// SessionOption configures optional Session behaviour
+type SessionOption func(*Session)
+
+// WithProbeTimeout sets how long path mtu discovery waits for a probe to be acknowledged
+func WithProbeTimeout(d time.Duration) SessionOption {
+	return func(s *Session) {
+		s.probeTimeout = d
+	}
+}
+
+// WithMaxProbes sets how many unacknowledged probes of one size mark it as undeliverable
+func WithMaxProbes(n int) SessionOption {
+	return func(s *Session) {
+		s.maxProbes = n
+	}
+}
+
+// WithPadding pads every frame the session sends according to the policy, the padding is
+// encrypted with the frame and stripped by the receiving session
+func WithPadding(p PaddingPolicy) SessionOption {
+	return func(s *Session) {
+		s.padding = p
+	}
+}
+
+type probeAck struct {
+	seq  uint32
+	size int
+}
+
+// NewSession creates a session with the peer using the agreed session id and key
+func NewSession(conn PacketConn, peer net.Addr, id [16]byte, key []byte, opts ...SessionOption) (*Session, error) {
+	aead, err := NewSessionCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+
+	s := &Session{
+		ID:           id,
+		conn:         conn,
+		peer:         peer,
+		aead:         aead,
+		probeTimeout: time.Second,
+		maxProbes:    3,
+		pmtu:         BasePLPMTU,
+		acks:         make(chan probeAck, 1),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if mtu := conn.MTU(); mtu < s.pmtu {
+		s.pmtu = mtu
+	}
+
+	s.bufs = newBufferPool(conn.MTU())
+
+	if s.compression != nil && s.compression.alg != CompressionDeflate {
+		return nil, fmt.Errorf("unsupported compression algorithm %d", s.compression.alg)
+	}
+
+	if s.cover != nil {
+		if err := s.cover.start(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Peer returns the address session payloads are sent to
+func (s *Session) Peer() net.Addr {
+	return s.peer
+}
+
+// PMTU returns the largest datagram confirmed to reach the peer
+func (s *Session) PMTU() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pmtu
+}
+
+// MaxPayload returns the most application data a single Write can carry
+func (s *Session) MaxPayload() int {
+	if s.cover != nil {
+		return s.cover.pad(0, s.PMTU()) - sessionOverhead - padTrailerLen
+	}
+	if s.padding != nil {
+		return s.PMTU() - sessionOverhead - padTrailerLen
+	}
+	return s.PMTU() - sessionOverhead
+}
+
+// Write encrypts and sends b to the peer as a single datagram, compressing it first if both
+// peers have agreed on compression
+func (s *Session) Write(b []byte) (int, error) {
+	if s.isClosed() {
+		return 0, ErrSessionClosed
+	}
+
+	kind, body, err := s.prepare(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.send(kind, body); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteBatch encrypts and sends each message as its own datagram, using as few system calls
+// as the connection allows. It returns the number of messages sent.
+func (s *Session) WriteBatch(msgs [][]byte) (int, error) {
+	if s.isClosed() {
+		return 0, ErrSessionClosed
+	}
+
+	// Cover traffic sends one frame per slot anyway
+	if s.cover != nil {
+		for i, b := range msgs {
+			if _, err := s.Write(b); err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+
+	batch := make([]BatchMessage, len(msgs))
+	bufs := make([]*[]byte, 0, len(msgs))
+	defer func() {
+		for _, bp := range bufs {
+			s.bufs.put(bp)
+		}
+	}()
+
+	for i, b := range msgs {
+		kind, body, err := s.prepare(b)
+		if err != nil {
+			return 0, err
+		}
+
+		bp := s.bufs.get()
+		bufs = append(bufs, bp)
+
+		out, err := s.seal(*bp, kind, body)
+		if err != nil {
+			return 0, err
+		}
+		batch[i] = BatchMessage{Buffers: [][]byte{out}, Addr: s.peer}
+	}
+
+	sent := 0
+	for sent < len(batch) {
+		n, err := s.conn.WriteBatch(batch[sent:], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			return sent, io.ErrShortWrite
+		}
+	}
+	return sent, nil
+}
+
+// prepare compresses b if agreed with the peer and checks it fits in a datagram
+func (s *Session) prepare(b []byte) (uint8, []byte, error) {
+	kind, body := frameData, b
+	if s.compression != nil {
+		if err := s.offerCompression(); err != nil {
+			return 0, nil, err
+		}
+
+		if c, ok := s.compression.compress(b); ok {
+			kind, body = frameData|flagCompressed, c
+		}
+	}
+
+	if len(body) > s.MaxPayload() {
+		return 0, nil, ErrMessageTooLarge
+	}
+	return kind, body, nil
+}
+
+// Close stops any background traffic of the session and refuses further writes, the shared
+// PacketConn is left open
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	if s.cover != nil {
+		s.cover.stop()
+	}
+	return nil
+}
+
+func (s *Session) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Handle decrypts a payload received for this session in place and answers any session
+// control frames. It returns the application data carried, or nil if there was none.
+func (s *Session) Handle(p SessionDataPayload) ([]byte, error) {
+	if p.SessionID != s.ID {
+		return nil, ErrWrongSession
+	}
+
+	plain, err := p.Open(s.aead)
+	if err != nil {
+		return nil, err
+	}
+	return s.handle(plain)
+}
+
+// HandleDatagram is Handle for an encoded session data payload, decrypting it within b
+// without copying. The returned data aliases b.
+func (s *Session) HandleDatagram(b []byte) ([]byte, error) {
+	if err := checkLen("session data", b, TypeSessionData, sessionHeaderLen+gcmTagLen, MaxMessageLen); err != nil {
+		return nil, err
+	}
+
+	if string(b[1:17]) != string(s.ID[:]) {
+		return nil, ErrWrongSession
+	}
+
+	plain, err := s.aead.Open(b[sessionHeaderLen:sessionHeaderLen], b[17:sessionHeaderLen], b[sessionHeaderLen:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.handle(plain)
+}
+
+// handle dispatches a decrypted session frame
+func (s *Session) handle(plain []byte) ([]byte, error) {
+	if len(plain) < frameHeaderLen {
+		return nil, errors.New("empty session frame")
+	}
+
+	plain, err := unpad(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	switch plain[0] & frameKindMask {
+	case frameData:
+		if plain[0]&flagCompressed != 0 {
+			return s.decompress(plain[frameHeaderLen:])
+		}
+		return plain[frameHeaderLen:], nil
+	case frameProbe:
+		return nil, s.ackProbe(plain)
+	case frameProbeAck:
+		return nil, s.receiveAck(plain)
+	case frameDummy:
+		return nil, nil
+	case frameCompression:
+		return nil, s.receiveCompressionOffer(plain[frameHeaderLen:])
+	}
+
+	return nil, fmt.Errorf("unsupported session frame %d", plain[0]&frameKindMask)
+}
+
+// DiscoverPMTU searches for the largest datagram the path to the peer delivers, between the
+// current path mtu and the mtu of the local interface. Each size is confirmed by a padded
+// probe which the peer must acknowledge, so Handle must keep being called on incoming
+// payloads while discovery runs.
+func (s *Session) DiscoverPMTU(ctx context.Context) (int, error) {
+	s.probing.Lock()
+	defer s.probing.Unlock()
+
+	lo, hi := s.PMTU(), s.conn.MTU()
+
+	// Most paths support the full local mtu, so try that before searching
+	size := hi
+	for lo < hi {
+		ok, err := s.probe(ctx, size)
+		if err != nil {
+			return s.PMTU(), err
+		}
+
+		if ok {
+			lo = size
+			s.mu.Lock()
+			s.pmtu = size
+			s.mu.Unlock()
+		} else {
+			hi = size - 1
+		}
+
+		size = (lo + hi + 1) / 2
+	}
+
+	return s.PMTU(), nil
+}
+
+// probe reports whether a datagram of the given size reached the peer
+func (s *Session) probe(ctx context.Context, size int) (bool, error) {
+	body := make([]byte, size-sessionHeaderLen-gcmTagLen-frameHeaderLen)
+
+	for i := 0; i < s.maxProbes; i++ {
+		s.mu.Lock()
+		s.seq++
+		seq := s.seq
+		s.mu.Unlock()
+
+		binary.BigEndian.PutUint32(body[0:4], seq)
+		binary.BigEndian.PutUint16(body[4:6], uint16(size))
+
+		if err := s.send(frameProbe, body); errors.Is(err, syscall.EMSGSIZE) {
+			// The local stack already knows the probe can't be delivered
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if ok, err := s.awaitAck(ctx, size); ok || err != nil {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Session) awaitAck(ctx context.Context, size int) (bool, error) {
+	timer := time.NewTimer(s.probeTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+			return false, nil
+		case ack := <-s.acks:
+			// Acks for earlier attempts at the same size are just as good
+			if ack.size == size {
+				return true, nil
+			}
+		}
+	}
+}
+
+func (s *Session) ackProbe(plain []byte) error {
+	if len(plain) < probeHeaderLen {
+		return errors.New("short path mtu probe")
+	}
+
+	return s.send(frameProbeAck, plain[frameHeaderLen:probeHeaderLen])
+}
+
+func (s *Session) receiveAck(plain []byte) error {
+	if len(plain) < probeHeaderLen {
+		return errors.New("short path mtu probe ack")
+	}
+
+	ack := probeAck{
+		seq:  binary.BigEndian.Uint32(plain[1:5]),
+		size: int(binary.BigEndian.Uint16(plain[5:7])),
+	}
+
+	// Nobody waiting means the ack is late, drop it
+	select {
+	case s.acks <- ack:
+	default:
+	}
+	return nil
+}
+
+// send seals a frame of the given kind and writes it to the peer, or queues it for the next
+// cover traffic slot
+func (s *Session) send(kind uint8, body []byte) error {
+	// Probes keep their own size but still take a slot, so they don't stand out in time
+	if s.cover != nil {
+		return s.cover.enqueue(kind, body)
+	}
+	return s.transmit(kind, body)
+}
+
+// transmit seals a frame of the given kind and writes it to the peer
+func (s *Session) transmit(kind uint8, body []byte) error {
+	bp := s.bufs.get()
+	defer s.bufs.put(bp)
+
+	out, err := s.seal(*bp, kind, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteTo(out, s.peer)
+	return err
+}
+
+// seal encodes a frame of the given kind as a session data payload in buf, growing it if
+// needed
+func (s *Session) seal(buf []byte, kind uint8, body []byte) ([]byte, error) {
+	n, pad, flags := frameHeaderLen+len(body), 0, uint8(0)
+
+	policy := s.padding
+	if s.cover != nil {
+		policy = s.cover.pad
+	}
+
+	// Probes are already padded to the size being probed
+	if policy != nil && kind != frameProbe {
+		flags |= flagPadded
+		n += padTrailerLen
+
+		size := sessionHeaderLen + gcmTagLen + n
+		if target := policy(size, s.PMTU()); target > size {
+			pad = target - size
+		}
+		if max := s.PMTU() - size; pad > max {
+			pad = max
+		}
+		if pad < 0 {
+			pad = 0
+		}
+		n += pad
+	}
+
+	// The frame is built after room for the header and sealed in place
+	if size := sessionHeaderLen + n + gcmTagLen; cap(buf) < size {
+		buf = make([]byte, size)
+	}
+
+	plain := buf[sessionHeaderLen : sessionHeaderLen+n]
+	plain[0] = kind | flags
+	copy(plain[frameHeaderLen:], body)
+
+	if flags&flagPadded != 0 {
+		padding := plain[frameHeaderLen+len(body) : n-padTrailerLen]
+		for i := range padding {
+			padding[i] = 0
+		}
+		binary.BigEndian.PutUint16(plain[n-padTrailerLen:], uint16(pad))
+	}
+
+	return AppendSessionData(buf[:0], s.aead, s.ID, plain)
+}
@@ -0,0 +1,442 @@
+package mp2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memConn is an in memory PacketConn connected to a peer memConn, dropping any datagram
+// larger than the path mtu
+type memConn struct {
+	peer    *memConn
+	addr    *net.UDPAddr
+	mtu     int
+	pathMTU int
+	reads   chan pkt
+
+	mu       sync.Mutex
+	closed   bool
+	deadline time.Time
+}
+
+func newMemConnPair(mtu, pathMTU int) (*memConn, *memConn) {
+	a := &memConn{addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024}, mtu: mtu, pathMTU: pathMTU, reads: make(chan pkt, 64)}
+	b := &memConn{addr: &net.UDPAddr{IP: NewIPv6(), Port: 1024}, mtu: mtu, pathMTU: pathMTU, reads: make(chan pkt, 64)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	if len(b) > c.mtu {
+		return 0, errors.New("message too long")
+	}
+	if len(b) <= c.pathMTU {
+		c.peer.deliver(pkt{data: append([]byte(nil), b...), addr: c.addr})
+	}
+	return len(b), nil
+}
+
+func (c *memConn) deliver(p pkt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.reads <- p
+	}
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p, ok := <-c.reads:
+		if !ok {
+			return 0, nil, net.ErrClosed
+		}
+		return cp(p.data, b), p.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *memConn) WriteBatch(ms []BatchMessage, flags int) (int, error) {
+	for i := range ms {
+		n, err := c.WriteTo(ms[i].Buffers[0], ms[i].Addr)
+		if err != nil {
+			return i, err
+		}
+		ms[i].N = n
+	}
+	return len(ms), nil
+}
+
+func (c *memConn) ReadMsg(b []byte) (int, PacketInfo, error) {
+	n, src, err := c.ReadFrom(b)
+	return n, PacketInfo{Src: src, Dst: c.addr.IP}, err
+}
+
+// ReadBatch waits for one datagram, then reads any others already waiting
+func (c *memConn) ReadBatch(ms []BatchMessage, flags int) (int, error) {
+	for i := range ms {
+		var p pkt
+		var ok bool
+		if i == 0 {
+			p, ok = <-c.reads
+		} else {
+			select {
+			case p, ok = <-c.reads:
+			default:
+				return i, nil
+			}
+		}
+		if !ok {
+			return i, net.ErrClosed
+		}
+		ms[i].N, ms[i].Addr = cp(p.data, ms[i].Buffers[0]), p.addr
+	}
+	return len(ms), nil
+}
+
+func (c *memConn) Group() net.Addr { return c.addr }
+func (c *memConn) MTU() int        { return c.mtu }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.reads)
+	}
+	return nil
+}
+
+// serve handles every session payload arriving on the conn, forwarding application data
+func serve(t *testing.T, c *memConn, s *Session, out chan<- []byte) {
+	buf := make([]byte, c.MTU())
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		p, err := ParseSessionDataPayload(buf[:n])
+		if err != nil {
+			t.Errorf("failed to parse session payload: %v", err)
+			continue
+		}
+
+		data, err := s.Handle(p)
+		if err != nil {
+			t.Errorf("failed to handle session payload: %v", err)
+		} else if data != nil && out != nil {
+			out <- data
+		}
+	}
+}
+
+func newSessionPair(t *testing.T, a, b *memConn, opts ...SessionOption) (*Session, *Session) {
+	key := bytes.Repeat([]byte{7}, 32)
+	id := [16]byte{1, 2, 3}
+
+	sa, err := NewSession(a, b.addr, id, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := NewSession(b, a.addr, id, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa, sb
+}
+
+func TestSessionWrite(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	sa, sb := newSessionPair(t, a, b)
+
+	out := make(chan []byte, 1)
+	go serve(t, b, sb, out)
+	defer b.Close()
+
+	if _, err := sa.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-out; string(got) != "hello" {
+		t.Errorf("expected hello, got %q", got)
+	}
+
+	if _, err := sa.Write(make([]byte, sa.MaxPayload()+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	sa, _ := newSessionPair(t, a, b)
+
+	if err := sa.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.Write([]byte("hello")); err != ErrSessionClosed {
+		t.Errorf("expected ErrSessionClosed from Write, got %v", err)
+	}
+	if _, err := sa.WriteBatch([][]byte{[]byte("hello")}); err != ErrSessionClosed {
+		t.Errorf("expected ErrSessionClosed from WriteBatch, got %v", err)
+	}
+	if len(b.reads) != 0 {
+		t.Errorf("expected nothing sent after close, got %d datagrams", len(b.reads))
+	}
+}
+
+func TestSessionDiscoverPMTU(t *testing.T) {
+	for _, pathMTU := range []int{1452, 1400, 1300, 1200} {
+		a, b := newMemConnPair(1452, pathMTU)
+		sa, sb := newSessionPair(t, a, b, WithProbeTimeout(10*time.Millisecond), WithMaxProbes(2))
+
+		go serve(t, a, sa, nil)
+		go serve(t, b, sb, nil)
+
+		pmtu, err := sa.DiscoverPMTU(context.Background())
+		a.Close()
+		b.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pmtu != pathMTU {
+			t.Errorf("expected pmtu %d, got %d", pathMTU, pmtu)
+		}
+		if sa.MaxPayload() != pathMTU-sessionOverhead {
+			t.Errorf("expected max payload %d, got %d", pathMTU-sessionOverhead, sa.MaxPayload())
+		}
+	}
+}
+
+// discardConn is a PacketConn that drops every write, and remembers the last one
+type discardConn struct {
+	memConn
+	last []byte
+}
+
+func (c *discardConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	c.last = append(c.last[:0], b...)
+	return len(b), nil
+}
+
+func newBenchSession(tb testing.TB, opts ...SessionOption) (*Session, *discardConn) {
+	c := &discardConn{memConn: memConn{mtu: 1452}}
+	s, err := NewSession(c, &net.UDPAddr{IP: NewIPv6(), Port: 1024}, [16]byte{1}, bytes.Repeat([]byte{7}, 32), opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s, c
+}
+
+func TestSessionZeroAlloc(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	s, c := newBenchSession(t, WithPadding(PadToBuckets(256)))
+	msg := []byte("hello")
+
+	if n := testing.AllocsPerRun(100, func() { s.Write(msg) }); n != 0 {
+		t.Errorf("expected no allocations per write, got %v", n)
+	}
+
+	buf := make([]byte, len(c.last))
+	if n := testing.AllocsPerRun(100, func() {
+		copy(buf, c.last)
+		if data, err := s.HandleDatagram(buf); err != nil || string(data) != "hello" {
+			t.Fatalf("failed to handle datagram: %q %v", data, err)
+		}
+	}); n != 0 {
+		t.Errorf("expected no allocations per read, got %v", n)
+	}
+}
+
+func TestSessionReadZeroAlloc(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	s, c := newBenchSession(t)
+	s.Write([]byte("hello"))
+	pool := newBufferPool(c.MTU())
+
+	// A read loop takes a pooled buffer, finds the session and decrypts in place, then
+	// returns the buffer
+	if n := testing.AllocsPerRun(100, func() {
+		bp := pool.get()
+		defer pool.put(bp)
+
+		n := copy(*bp, c.last)
+		p, err := ParseSessionDataPayloadInPlace((*bp)[:n])
+		if err != nil || p.SessionID != s.ID {
+			t.Fatal(err)
+		}
+		if data, err := s.HandleDatagram((*bp)[:n]); err != nil || string(data) != "hello" {
+			t.Fatalf("failed to handle payload: %q %v", data, err)
+		}
+	}); n != 0 {
+		t.Errorf("expected no allocations per pooled read, got %v", n)
+	}
+}
+
+// TestSessionConnZeroAlloc checks a session adds no allocations to those of a real
+// connection, which are up to the platform
+func TestSessionConnZeroAlloc(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	ifi := multicastIfi(t)
+
+	c, err := NewConn(ifi, net.ParseIP("ff12::4d50:3251"), 20002)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+
+	// Writing to the group loops back, so the session reads its own frames
+	s, err := NewSession(c, c.Group(), [16]byte{1}, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello")
+	raw := make([]byte, sessionOverhead+len(msg))
+	pool := newBufferPool(c.MTU())
+
+	read := func(handle bool) {
+		c.SetDeadline(time.Now().Add(time.Second))
+		bp := pool.get()
+		defer pool.put(bp)
+
+		n, _, err := c.ReadFrom(*bp)
+		if err != nil {
+			t.Skipf("multicast loopback unavailable: %v", err)
+		}
+		if !handle {
+			return
+		}
+
+		if p, err := ParseSessionDataPayloadInPlace((*bp)[:n]); err != nil || p.SessionID != s.ID {
+			t.Fatalf("failed to parse payload: %v", err)
+		}
+		if data, err := s.HandleDatagram((*bp)[:n]); err != nil || string(data) != "hello" {
+			t.Fatalf("failed to handle payload: %q %v", data, err)
+		}
+	}
+
+	conn := testing.AllocsPerRun(50, func() {
+		c.WriteTo(raw, c.Group())
+		read(false)
+	})
+	sess := testing.AllocsPerRun(50, func() {
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		read(true)
+	})
+	if sess > conn {
+		t.Errorf("expected no allocations beyond the connection's %v, got %v", conn, sess)
+	}
+}
+
+func BenchmarkSessionWrite(b *testing.B) {
+	s, _ := newBenchSession(b)
+	msg := make([]byte, 1024)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionHandleDatagram(b *testing.B) {
+	s, c := newBenchSession(b)
+	msg := make([]byte, 1024)
+	s.Write(msg)
+
+	buf := make([]byte, len(c.last))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		copy(buf, c.last)
+		if _, err := s.HandleDatagram(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionReadPooled(b *testing.B) {
+	s, c := newBenchSession(b)
+	msg := make([]byte, 1024)
+	s.Write(msg)
+	pool := newBufferPool(c.MTU())
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		bp := pool.get()
+		n := copy(*bp, c.last)
+		if p, err := ParseSessionDataPayloadInPlace((*bp)[:n]); err != nil || p.SessionID != s.ID {
+			b.Fatal(err)
+		}
+		if _, err := s.HandleDatagram((*bp)[:n]); err != nil {
+			b.Fatal(err)
+		}
+		pool.put(bp)
+	}
+}
+
+func TestSessionWriteBatch(t *testing.T) {
+	a, b := newMemConnPair(1452, 1452)
+	sa, sb := newSessionPair(t, a, b)
+
+	msgs := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if n, err := sa.WriteBatch(msgs); err != nil || n != len(msgs) {
+		t.Fatalf("expected %d messages written, got %d with %v", len(msgs), n, err)
+	}
+
+	batch := make([]BatchMessage, 8)
+	for i := range batch {
+		batch[i].Buffers = [][]byte{make([]byte, b.MTU())}
+	}
+
+	n, err := b.ReadBatch(batch, 0)
+	if err != nil || n != len(msgs) {
+		t.Fatalf("expected %d messages read, got %d with %v", len(msgs), n, err)
+	}
+
+	for i, m := range batch[:n] {
+		data, err := sb.HandleDatagram(m.Buffers[0][:m.N])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msgs[i]) {
+			t.Errorf("expected %q, got %q", msgs[i], data)
+		}
+	}
+}
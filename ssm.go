@@ -0,0 +1,89 @@
+package mp2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// SourceFilter is implemented by connections created WithSourceSpecific, restricting the
+// connection's group to datagrams from allowed unicast sources
+type SourceFilter interface {
+	// AddSource allows datagrams to the group from the source on every interface
+	AddSource(src net.IP) error
+
+	// RemoveSource stops receiving datagrams to the group from the source
+	RemoveSource(src net.IP) error
+
+	// Sources returns the allowed sources
+	Sources() []net.IP
+}
+
+// ErrNotSourceSpecific is returned when filtering the sources of an any source connection
+var ErrNotSourceSpecific = errors.New("connection is not source specific")
+
+// sourceFunc joins or leaves a group for a single source on an interface
+type sourceFunc func(ifi *net.Interface, group, source net.Addr) error
+
+// sourceSet is the allowed sources of a source specific connection's group
+type sourceSet struct {
+	join, leave sourceFunc
+	sources     []net.IP
+}
+
+func newSourceSet(group net.IP, sources []net.IP, join, leave sourceFunc) (*sourceSet, error) {
+	if !isSSM(group) {
+		return nil, fmt.Errorf("group %s is not source specific", group)
+	}
+
+	s := &sourceSet{join: join, leave: leave}
+	for _, src := range sources {
+		if !s.allowed(src) {
+			s.sources = append(s.sources, src)
+		}
+	}
+	return s, nil
+}
+
+func (s *sourceSet) allowed(src net.IP) bool {
+	for _, allowed := range s.sources {
+		if allowed.Equal(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinAll joins the group for every allowed source
+func (s *sourceSet) joinAll(ifi *net.Interface, group net.Addr) error {
+	for _, src := range s.sources {
+		if err := s.join(ifi, group, &net.UDPAddr{IP: src}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaveAll leaves the group for every allowed source
+func (s *sourceSet) leaveAll(ifi *net.Interface, group net.Addr) (err error) {
+	for _, src := range s.sources {
+		if lerr := s.leave(ifi, group, &net.UDPAddr{IP: src}); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// isSSM reports whether the address is in a source specific multicast range, 232.0.0.0/8
+// or ff3x::/32
+func isSSM(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 232
+	}
+	return len(ip) == net.IPv6len && ip[0] == 0xff && ip[1]&0xf0 == 0x30 && ip[2] == 0 && ip[3] == 0
+}
+
+var (
+	_ SourceFilter = (*ipv4Conn)(nil)
+	_ SourceFilter = (*ipv6Conn)(nil)
+)
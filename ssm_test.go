@@ -0,0 +1,110 @@
+package mp2p
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSSMAddrs(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if ip := NewSSMIPv6(); !isSSM(ip) || ip[12]&0x80 == 0 {
+			t.Fatalf("expected dynamic ssm address, got %s", ip)
+		}
+		if ip := NewSSMIPv4(); !isSSM(ip) || ip[1] == 0 && ip[2] == 0 {
+			t.Fatalf("expected unreserved ssm address, got %s", ip)
+		}
+	}
+
+	for _, ip := range []string{"224.0.250.1", "ff1e::1", "ff3e:40:2001:db8::1"} {
+		if isSSM(net.ParseIP(ip)) {
+			t.Errorf("expected %s not to be source specific", ip)
+		}
+	}
+}
+
+func TestMembershipSources(t *testing.T) {
+	joined := map[string]bool{}
+	join := func(ifi *net.Interface, group, source net.Addr) error {
+		joined[source.String()] = true
+		return nil
+	}
+	leave := func(ifi *net.Interface, group, source net.Addr) error {
+		delete(joined, source.String())
+		return nil
+	}
+
+	group := &net.UDPAddr{IP: net.ParseIP("232.1.2.3")}
+	cfg := newConnConfig([]ConnOption{WithSourceSpecific(net.ParseIP("192.0.2.10"))})
+	m, err := newConnMembership([]*net.Interface{{Index: 1, Name: "eth0"}}, group, cfg, nil, join, leave)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.addSource(net.ParseIP("192.0.2.11")); err != nil {
+		t.Fatal(err)
+	}
+	if len(joined) != 2 || len(m.Sources()) != 2 {
+		t.Errorf("expected 2 sources, got %v", m.Sources())
+	}
+
+	if err := m.removeSource(net.ParseIP("192.0.2.10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.removeSource(net.ParseIP("192.0.2.10")); err == nil {
+		t.Error("expected removing twice to fail")
+	}
+
+	if err := m.leaveAll(nil); err != nil || len(joined) != 0 {
+		t.Errorf("expected every source left, still %v with %v", joined, err)
+	}
+
+	cfg = newConnConfig([]ConnOption{WithSourceSpecific()})
+	if _, err := newConnMembership(nil, &net.UDPAddr{IP: net.ParseIP("224.0.250.1")}, cfg, nil, join, leave); err == nil {
+		t.Error("expected any source group to be rejected")
+	}
+
+	m = &membership{group: group}
+	if err := m.addSource(net.ParseIP("192.0.2.10")); !errors.Is(err, ErrNotSourceSpecific) {
+		t.Errorf("expected ErrNotSourceSpecific, got %v", err)
+	}
+}
+
+func TestSourceSpecificConn(t *testing.T) {
+	ifi := multicastIfi(t)
+
+	var self net.IP
+	addrs, _ := ifi.Addrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+			self = n.IP
+		}
+	}
+	if self == nil {
+		t.Skip("no ipv4 address")
+	}
+
+	c, err := NewConn(ifi, net.ParseIP("232.1.250.1"), 20003, WithLoopback(true), WithSourceSpecific())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Close()
+
+	if err := c.(SourceFilter).AddSource(self); err != nil {
+		t.Skip(err)
+	}
+
+	if _, err := c.WriteTo([]byte("hello"), c.Group()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, _, err := c.ReadFrom(make([]byte, c.MTU())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.(SourceFilter).RemoveSource(self); err != nil {
+		t.Fatal(err)
+	}
+}